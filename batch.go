@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeBatch queues writes until the next global.flushSchedule tick. nil
+// when writes go out as soon as they're scraped.
+var writeBatch *batcher
+
+// submitData writes payload now, or queues it for the next scheduled flush
+// unless the insert opted out with batch: false. Health is recorded once the
+// data has actually been written.
+func submitData(config Config, payload string) error {
+	if writeBatch != nil && !config.SKIP_BATCH {
+		writeBatch.add(config, payload)
+		return nil
+	}
+	if err := writeData(config, payload); err != nil {
+		return err
+	}
+	health.recordSuccess(config.DB_ATTRIBUTE_NAME)
+	return nil
+}
+
+// pendingWrite collects the lines bound for one database URL
+type pendingWrite struct {
+	config Config
+	lines  []string
+	names  map[string]bool
+}
+
+// batcher accumulates line protocol per destination. Each line keeps the
+// timestamp of the scrape that produced it.
+type batcher struct {
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+}
+
+func newBatcher() *batcher {
+	return &batcher{pending: make(map[string]*pendingWrite)}
+}
+
+func (b *batcher) add(config Config, payload string) {
+	// Inserts sharing a destination and encoding are written together
+	key := fmt.Sprintf("%s|%s|%d", config.DATABASE_URL, config.PRECISION, config.UDP_MAX_DATAGRAM)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	write, ok := b.pending[key]
+	if !ok {
+		write = &pendingWrite{config: config, names: make(map[string]bool)}
+		b.pending[key] = write
+	}
+	write.lines = append(write.lines, payload)
+	write.names[config.DB_ATTRIBUTE_NAME] = true
+}
+
+// flush writes everything queued so far
+func (b *batcher) flush() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]*pendingWrite)
+	b.mu.Unlock()
+
+	for _, key := range sortedKeys(pending) {
+		write := pending[key]
+		if err := writeLines(write.config, write.lines); err != nil {
+			log.Printf("Failed to flush %d batched writes to %s : %v", len(write.lines), write.config.DATABASE_URL, err)
+			continue
+		}
+		for name := range write.names {
+			health.recordSuccess(name)
+		}
+	}
+}
+
+// run flushes at each time given by sched, forever
+func (b *batcher) run(sched schedule) {
+	for {
+		time.Sleep(time.Until(sched.next(time.Now())))
+		b.flush()
+	}
+}
+
+// schedule reports when a flush is next due
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// everySchedule fires at a fixed interval
+type everySchedule time.Duration
+
+func (e everySchedule) next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// cronSchedule fires when every field matches. Fields are seconds, minutes,
+// hours, day of month, month and day of week. As in standard cron, when both
+// day fields are restricted a day matching either of them is enough.
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow map[int]bool
+	// eitherDay is set when neither day field starts with *
+	eitherDay bool
+}
+
+// parseSchedule accepts "@every <duration>" or a cron spec with either five
+// fields (minute hour dom month dow) or six with a leading seconds field.
+// Each field is *, a number, */step, a-b, a-b/step, or a comma list of these.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if every, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil {
+			return nil, fmt.Errorf("invalid @every duration: %v", err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("@every duration must be at least 1s")
+		}
+		return everySchedule(d), nil
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("expected @every or 5 or 6 cron fields, got %q", spec)
+	}
+	bounds := [6][2]int{{0, 59}, {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var sets [6]map[int]bool
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron field %q: %v", field, err)
+		}
+		sets[i] = set
+	}
+	return cronSchedule{
+		second:    sets[0],
+		minute:    sets[1],
+		hour:      sets[2],
+		dom:       sets[3],
+		month:     sets[4],
+		dow:       sets[5],
+		eitherDay: !strings.HasPrefix(fields[3], "*") && !strings.HasPrefix(fields[5], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return nil, fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return nil, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// matchesDay reports whether t falls on a scheduled day
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	if c.eitherDay {
+		return c.dom[t.Day()] || c.dow[int(t.Weekday())]
+	}
+	return c.dom[t.Day()] && c.dow[int(t.Weekday())]
+}
+
+// next finds the first matching second after after, skipping whole months,
+// days, hours and minutes that can't match
+func (c cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Second).Add(time.Second)
+	// Give up after five years, which only happens for impossible dates
+	// like 30 February
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+		case !c.second[t.Second()]:
+			t = t.Add(time.Second)
+		default:
+			return t
+		}
+	}
+	return limit
+}
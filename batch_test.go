@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleDays(t *testing.T) {
+	// Thursday 2024-02-29
+	start := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want []time.Time
+	}{
+		// Both day fields restricted: the 1st or any Monday
+		{"0 0 1 * 1", []time.Time{
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+		}},
+		// Only day of week restricted: Mondays
+		{"0 0 * * 1", []time.Time{
+			time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+		}},
+		// Only day of month restricted: the 1st
+		{"0 0 1 * *", []time.Time{
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		}},
+	}
+	for _, tt := range tests {
+		sched, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		at := start
+		for _, want := range tt.want {
+			at = sched.next(at)
+			if !at.Equal(want) {
+				t.Errorf("%s: next = %v, want %v", tt.spec, at, want)
+				break
+			}
+		}
+	}
+}
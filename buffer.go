@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"scrape/influx"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxBufferSegments caps the on-disk buffer unless overridden by
+	// global.maxBufferSegments
+	defaultMaxBufferSegments = 1000
+	// bufferDrainInterval is how often buffered writes are retried
+	bufferDrainInterval = 30 * time.Second
+	bufferSegmentExt    = ".lp.gz"
+)
+
+// writeBuffer holds HTTP writes that failed so they can be retried once the
+// database is reachable again. nil when global.bufferDir isn't set.
+var writeBuffer *diskBuffer
+
+// diskBuffer stores each failed write as a gzip-compressed segment file
+// holding the write URL on the first line and the line protocol after it.
+// Segment names sort by creation time, so the drain flushes the oldest first
+// and deletes each segment once it has been written. Lines older than maxAge
+// are dropped rather than written, unless maxAge is zero. precision is the
+// global.precision the buffered timestamps were written in.
+type diskBuffer struct {
+	mu          sync.Mutex
+	dir         string
+	maxSegments int
+	maxAge      time.Duration
+	precision   string
+	seq         int
+}
+
+func newDiskBuffer(dir string, maxSegments int, maxAge time.Duration, precision string) (*diskBuffer, error) {
+	if maxSegments <= 0 {
+		maxSegments = defaultMaxBufferSegments
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create buffer directory: %v", err)
+	}
+	return &diskBuffer{dir: dir, maxSegments: maxSegments, maxAge: maxAge, precision: precision}, nil
+}
+
+// store writes a new segment for payload, dropping the oldest segments if
+// that takes the buffer over its cap
+func (b *diskBuffer) store(writeURL, payload string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var data bytes.Buffer
+	zw := gzip.NewWriter(&data)
+	if _, err := io.WriteString(zw, writeURL+"\n"+payload); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	b.seq++
+	name := filepath.Join(b.dir, fmt.Sprintf("%019d-%06d%s", time.Now().UnixNano(), b.seq%1000000, bufferSegmentExt))
+	// Write under a temporary name so the drain never sees a partial segment
+	if err := os.WriteFile(name+".tmp", data.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	segments, err := b.segments()
+	if err != nil {
+		return err
+	}
+	for len(segments) > b.maxSegments {
+		log.Printf("Write buffer is over %d segments, dropping oldest %s", b.maxSegments, filepath.Base(segments[0]))
+		if err := os.Remove(segments[0]); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// segments returns the segment paths, oldest first
+func (b *diskBuffer) segments() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(b.dir, "*"+bufferSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// drain writes buffered segments oldest first, stopping at the first failure
+// so ordering is kept while the database is still unavailable
+func (b *diskBuffer) drain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	segments, err := b.segments()
+	if err != nil {
+		log.Printf("Failed to list write buffer: %v", err)
+		return
+	}
+	for _, segment := range segments {
+		writeURL, payload, err := readSegment(segment)
+		if err != nil {
+			log.Printf("Dropping unreadable buffer segment %s: %v", filepath.Base(segment), err)
+			os.Remove(segment)
+			continue
+		}
+		if b.maxAge > 0 {
+			var stale int
+			payload, stale = dropStale(payload, b.precision, time.Now().Add(-b.maxAge))
+			if stale > 0 {
+				health.recordStaleDropped(stale)
+				log.Printf("Dropped %d lines older than %v from buffer segment %s", stale, b.maxAge, filepath.Base(segment))
+			}
+			if payload == "" {
+				os.Remove(segment)
+				segments = segments[1:]
+				continue
+			}
+		}
+		if err := postDataToInfluxDB(writeURL, payload); err != nil {
+			log.Printf("Write buffer drain paused, %d segments left: %v", len(segments), err)
+			return
+		}
+		if err := os.Remove(segment); err != nil {
+			log.Printf("Failed to remove flushed buffer segment %s: %v", filepath.Base(segment), err)
+			return
+		}
+		segments = segments[1:]
+		log.Printf("Flushed buffer segment %s", filepath.Base(segment))
+	}
+}
+
+// drainLoop retries buffered writes every bufferDrainInterval
+func (b *diskBuffer) drainLoop() {
+	for {
+		b.drain()
+		time.Sleep(bufferDrainInterval)
+	}
+}
+
+// dropStale removes the lines of payload timestamped before cutoff, returning
+// what is left and how many lines were dropped. The timestamps are read in
+// the given precision. Lines without a timestamp are kept.
+func dropStale(payload, precision string, cutoff time.Time) (string, int) {
+	unit := influx.PrecisionUnit(precision)
+	var kept []string
+	dropped := 0
+	for _, line := range strings.Split(payload, "\n") {
+		// The timestamp, when there is one, is the last space separated token
+		ts, err := strconv.ParseInt(line[strings.LastIndexByte(line, ' ')+1:], 10, 64)
+		if err == nil && time.Unix(0, 0).Add(time.Duration(ts)*unit).Before(cutoff) {
+			dropped++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n"), dropped
+}
+
+func readSegment(path string) (writeURL, payload string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", "", err
+	}
+	writeURL, payload, ok := strings.Cut(string(data), "\n")
+	if !ok || writeURL == "" {
+		return "", "", fmt.Errorf("missing write URL")
+	}
+	return writeURL, payload, nil
+}
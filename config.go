@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMinInterval is the shortest waitTime allowed unless overridden by
+// global.minInterval
+const defaultMinInterval = 5
+
+// clampInterval raises waitTime to minInterval so a typo can't turn an insert
+// into a tight loop hammering the target and the database
+func clampInterval(name string, waitTime, minInterval int) int {
+	if waitTime < minInterval {
+		log.Printf("[%s] waitTime %ds is below the minimum interval, using %ds", name, waitTime, minInterval)
+		return minInterval
+	}
+	return waitTime
+}
+
+// resolveDatabaseURL picks the insert's database URL, falling back to the
+// global one, and applies global.writePath to HTTP URLs for Influx-compatible
+// backends that serve writes somewhere other than /write or /api/v2/write.
+// For InfluxDB v2 write URLs, global.org or global.orgID and global.bucket
+// are added to the query string unless it already names them.
+func resolveDatabaseURL(insertURL string, global GlobalConfig) (string, error) {
+	db := insertURL
+	if db == "" {
+		db = global.DatabaseURL
+	}
+	if strings.HasPrefix(db, "udp://") {
+		return db, nil
+	}
+	u, err := url.Parse(db)
+	if err != nil {
+		return db, nil
+	}
+	if global.WritePath != "" {
+		u.Path = global.WritePath
+		u.RawPath = ""
+	}
+	if !strings.Contains(u.Path, "/api/v2/") {
+		if global.WritePath == "" {
+			return db, nil
+		}
+		return u.String(), nil
+	}
+	q := u.Query()
+	if q.Get("org") == "" && q.Get("orgID") == "" {
+		// Some v2 setups only accept the org ID
+		switch {
+		case global.OrgID != "":
+			q.Set("orgID", global.OrgID)
+		case global.Org != "":
+			q.Set("org", global.Org)
+		default:
+			return "", fmt.Errorf("v2 write URL %s needs global.org or global.orgID", u.Redacted())
+		}
+	}
+	if q.Get("org") != "" && q.Get("orgID") != "" {
+		return "", fmt.Errorf("v2 write URL %s can't have both org and orgID", u.Redacted())
+	}
+	if q.Get("bucket") == "" && global.Bucket != "" {
+		q.Set("bucket", global.Bucket)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// loadCACerts reads a PEM bundle of CA certificates to trust for an insert's
+// target, in addition to the system roots
+func loadCACerts(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// influxVersion reports which InfluxDB write API a database URL targets: "2"
+// for /api/v2/ paths and "1" otherwise, including UDP, which only v1 accepts
+func influxVersion(db string) string {
+	if u, err := url.Parse(db); err == nil && strings.Contains(u.Path, "/api/v2/") {
+		return "2"
+	}
+	return "1"
+}
+
+// scraperHostname returns the value for global.hostnameTag. SCRAPE_HOSTNAME
+// takes precedence, which helps in containers where os.Hostname is a random ID.
+func scraperHostname() string {
+	if name := os.Getenv("SCRAPE_HOSTNAME"); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		log.Printf("Failed to determine hostname for hostnameTag: %v", err)
+		return "unknown"
+	}
+	return name
+}
+
+// nameTags applies global.nameTagRegex to an insert name, returning a tag
+// for each named capture group that matched. Names the regex doesn't match
+// get no tags.
+func nameTags(re *regexp.Regexp, name string) map[string]string {
+	if re == nil {
+		return nil
+	}
+	match := re.FindStringSubmatch(name)
+	if match == nil {
+		debugf("[%s] Insert name doesn't match nameTagRegex", name)
+		return nil
+	}
+	tags := make(map[string]string)
+	for i, group := range re.SubexpNames() {
+		if group != "" && match[i] != "" {
+			tags[group] = match[i]
+		}
+	}
+	return tags
+}
+
+// requestOptions works out the HTTP method, body and content type for an
+// insert. A form map is URL-encoded into the body and implies a form POST.
+func requestOptions(entry InsertConfig) (method, body, contentType string, err error) {
+	method = strings.ToUpper(entry.Method)
+	body = entry.Body
+	contentType = entry.ContentType
+	if len(entry.Form) > 0 {
+		if body != "" {
+			return "", "", "", fmt.Errorf("body and form can't both be set")
+		}
+		form := url.Values{}
+		for key, val := range entry.Form {
+			form.Set(key, val)
+		}
+		body = form.Encode()
+		if contentType == "" {
+			contentType = "application/x-www-form-urlencoded"
+		}
+		if method == "" {
+			method = http.MethodPost
+		}
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	return method, body, contentType, nil
+}
+
+// configFile is one decoded YAML file, kept separate until duplicate insert
+// names across files have been resolved
+type configFile struct {
+	path   string
+	insert map[string]InsertConfig
+}
+
+// readYAMLConfig loads path, which may be a single YAML file or a directory
+// of *.yaml / *.yml files read in lexical order. Global settings from later
+// files override earlier ones key by key. Inserts defined in more than one
+// file are resolved with global.onDuplicate.
+func readYAMLConfig(path string) (YAMLConfig, error) {
+	paths, err := configPaths(path)
+	if err != nil {
+		return YAMLConfig{}, err
+	}
+
+	var yconf YAMLConfig
+	var files []configFile
+	for _, p := range paths {
+		// Decoding over the merged global only replaces keys present in p
+		overlay := YAMLConfig{Global: yconf.Global}
+		if err := decodeYAMLFile(p, &overlay); err != nil {
+			return YAMLConfig{}, err
+		}
+		yconf.Global = overlay.Global
+		files = append(files, configFile{path: p, insert: overlay.Insert})
+	}
+
+	if len(files) == 1 {
+		yconf.Insert = files[0].insert
+		return yconf, nil
+	}
+	yconf.Insert, err = mergeInserts(files, yconf.Global.OnDuplicate)
+	return yconf, err
+}
+
+func configPaths(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open YAML file: %v", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config directory: %v", err)
+	}
+	var paths []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			paths = append(paths, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no YAML files found in %s", path)
+	}
+	return paths, nil
+}
+
+func decodeYAMLFile(path string, yconf *YAMLConfig) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open YAML file: %v", err)
+	}
+	defer file.Close()
+
+	if err := yaml.NewDecoder(file).Decode(yconf); err != nil {
+		return fmt.Errorf("failed to decode YAML %s: %v", path, err)
+	}
+	return nil
+}
+
+// mergeInserts combines the inserts of several files. policy is one of
+// error (default), first, last or merge. merge keeps the first definition's
+// settings and unions the field maps; when both define the same field, the
+// first definition wins.
+func mergeInserts(files []configFile, policy string) (map[string]InsertConfig, error) {
+	switch policy {
+	case "":
+		policy = "error"
+	case "error", "first", "last", "merge":
+	default:
+		return nil, fmt.Errorf("global.onDuplicate must be one of error, first, last or merge")
+	}
+
+	merged := make(map[string]InsertConfig)
+	sources := make(map[string][]string)
+	for _, file := range files {
+		for name, entry := range file.insert {
+			existing, duplicate := merged[name]
+			sources[name] = append(sources[name], file.path)
+			switch {
+			case !duplicate, policy == "last":
+				merged[name] = entry
+			case policy == "error":
+				return nil, fmt.Errorf("insert [%s] is defined in both %s and %s", name, sources[name][0], file.path)
+			case policy == "merge":
+				if existing.Fields == nil {
+					existing.Fields = make(map[string]FieldConfig)
+				}
+				for fieldName, field := range entry.Fields {
+					if _, ok := existing.Fields[fieldName]; ok {
+						log.Printf("[%s] Field [%s] from %s ignored, already defined", name, fieldName, file.path)
+						continue
+					}
+					existing.Fields[fieldName] = field
+				}
+				merged[name] = existing
+			}
+		}
+	}
+
+	for name, paths := range sources {
+		if len(paths) < 2 {
+			continue
+		}
+		switch policy {
+		case "first":
+			log.Printf("[%s] Defined in %s, using %s", name, strings.Join(paths, ", "), paths[0])
+		case "last":
+			log.Printf("[%s] Defined in %s, using %s", name, strings.Join(paths, ", "), paths[len(paths)-1])
+		case "merge":
+			log.Printf("[%s] Defined in %s, merged fields", name, strings.Join(paths, ", "))
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"scrape/docker"
+	"scrape/influx"
+	"scrape/query"
+	"strings"
+	"time"
+)
+
+// diagnosis collects the results of --diagnose checks
+type diagnosis struct {
+	failed bool
+}
+
+func (d *diagnosis) pass(check, format string, args ...interface{}) {
+	fmt.Printf("[PASS] %-8s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) fail(check, format string, args ...interface{}) {
+	d.failed = true
+	fmt.Printf("[FAIL] %-8s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) skip(check, format string, args ...interface{}) {
+	fmt.Printf("[SKIP] %-8s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// diagnose runs one-shot connectivity checks for the named insert, printing
+// a report. It returns false if any check failed.
+func diagnose(configs []Config, name string) bool {
+	var config *Config
+	for i := range configs {
+		if configs[i].DB_ATTRIBUTE_NAME == name {
+			config = &configs[i]
+		}
+	}
+	d := &diagnosis{}
+	if config == nil {
+		d.fail("config", "no valid insert named %s", name)
+		return false
+	}
+	fmt.Printf("Diagnosing [%s]\n", name)
+
+	if config.IS_DOCKER_STATS {
+		for _, endpoint := range config.DOCKER_ENDPOINTS {
+			info, err := docker.NewClient(endpoint).GetInfo()
+			if err != nil {
+				d.fail("docker", "%s : %v", endpoint, err)
+				continue
+			}
+			d.pass("docker", "%s reports %d containers", endpoint, info.Containers)
+		}
+	} else {
+		diagnoseTarget(d, *config)
+	}
+	diagnoseWrite(d, *config)
+
+	if d.failed {
+		fmt.Println("Some checks failed")
+		return false
+	}
+	fmt.Println("All checks passed")
+	return true
+}
+
+// diagnoseTarget checks that the target resolves, responds with JSON and
+// that every field query matches something
+func diagnoseTarget(d *diagnosis, config Config) {
+	target, err := url.Parse(config.GET_REQUEST_TARGET)
+	if err != nil {
+		d.fail("url", "%v", err)
+		return
+	}
+	if target.Scheme == "file" {
+		d.skip("dns", "file target")
+	} else if addrs, err := net.LookupHost(target.Hostname()); err != nil {
+		d.fail("dns", "%v", err)
+	} else {
+		d.pass("dns", "%s resolves to %s", target.Hostname(), strings.Join(addrs, ", "))
+	}
+
+	body, err := fetchBody(scrapeClient(config), config)
+	if err != nil {
+		d.fail("http", "%v", err)
+		return
+	}
+	data, err := decodeBody(config, body)
+	if err != nil {
+		d.fail("parse", "%v", err)
+		return
+	}
+	d.pass("http", "%s returned %d bytes", config.GET_REQUEST_TARGET, len(body))
+
+	if data, err = fromBase(config, data); err != nil {
+		d.fail("root", "%v", err)
+		return
+	}
+
+	if config.FOR_EACH != "" {
+		value, err := query.Resolve(data, config.FOR_EACH)
+		members, ok := value.(map[string]interface{})
+		if err != nil || !ok || len(members) == 0 {
+			d.fail("forEach", "%s did not match a non-empty object", config.FOR_EACH)
+			return
+		}
+		// Fields are checked against the first member
+		key := sortedKeys(members)[0]
+		d.pass("forEach", "%s matched %d members, checking fields against %s", config.FOR_EACH, len(members), key)
+		data = members[key]
+	}
+
+	for _, fieldName := range sortedKeys(config.FIELDS) {
+		field := config.FIELDS[fieldName]
+		switch {
+		case field.compute != nil:
+			d.skip("field", "[%s] is computed", fieldName)
+		case field.program != nil:
+			if _, err := evalExpr(field.program, data, config.NUMBER_FORMAT); err != nil {
+				d.fail("field", "[%s] %v", fieldName, err)
+			} else {
+				d.pass("field", "[%s] %s evaluated", fieldName, field.Expr)
+			}
+		case field.absent(data):
+			d.fail("field", "[%s] %s matched nothing", fieldName, strings.Join(field.candidates(), ", "))
+		default:
+			d.pass("field", "[%s] %s matched", fieldName, field.Query)
+		}
+	}
+}
+
+// diagnoseWrite sends a test point to the insert's database
+func diagnoseWrite(d *diagnosis, config Config) {
+	point := influx.Point{
+		Measurement: "scrape_diagnostics",
+		Tags:        map[string]string{"insert": config.DB_ATTRIBUTE_NAME},
+		Fields:      map[string]interface{}{"ok": 1},
+		Time:        time.Now(),
+	}
+	payload := point.Line(config.PRECISION)
+	var err error
+	if strings.HasPrefix(config.DATABASE_URL, "udp://") {
+		err = sendDataToUDP(config.DATABASE_URL, payload, config.UDP_MAX_DATAGRAM)
+	} else {
+		err = postDataToInfluxDB(withPrecision(config.DATABASE_URL, config.PRECISION), payload)
+	}
+	if err != nil {
+		d.fail("write", "%s : %v", config.DATABASE_URL, err)
+		return
+	}
+	d.pass("write", "%s accepted a test point", config.DATABASE_URL)
+}
@@ -4,12 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"regexp"
+	"scrape/influx"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// unlimitedMemorySentinel is the limit reported by cgroup v1 when a container
+// has no memory limit (page-aligned math.MaxInt64)
+const unlimitedMemorySentinel = 9223372036854771712
+
 // Container represents a Docker container from the API
 type Container struct {
 	ID     string   `json:"Id"`
@@ -127,57 +136,204 @@ type Stats struct {
 // Client wraps HTTP client for Docker API communication
 type Client struct {
 	httpClient *http.Client
+	// baseURL is prepended to API paths: http://localhost for unix sockets,
+	// where the host is ignored, or the daemon's address for TCP
+	baseURL string
+
+	// lists holds the latest container list per collection interval, so
+	// collectors sharing the endpoint and interval list once per cycle
+	// between them however far apart their ticks fall
+	listMu sync.Mutex
+	lists  map[time.Duration]containerList
+}
+
+// containerList is a container list and when it was fetched
+type containerList struct {
+	containers []Container
+	at         time.Time
+}
+
+var (
+	sharedMu      sync.Mutex
+	sharedClients = make(map[string]*Client)
+	connLimits    ConnLimits
+)
+
+// ConnLimits bounds the connections a Client opens to its daemon's socket.
+// Zero leaves a limit at the net/http default.
+type ConnLimits struct {
+	// MaxIdleConns is the number of idle connections kept for reuse
+	MaxIdleConns int
+	// MaxConnsPerHost caps connections in any state; requests beyond it
+	// wait for one to free up
+	MaxConnsPerHost int
+}
+
+// SetConnLimits applies limits to clients created from now on
+func SetConnLimits(limits ConnLimits) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	connLimits = limits
+}
+
+// SharedClient returns the client for endpoint, creating it on first use, so
+// collectors pointing at the same daemon share its connections
+func SharedClient(endpoint string) *Client {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	client, ok := sharedClients[endpoint]
+	if !ok {
+		client = newClient(endpoint, connLimits)
+		sharedClients[endpoint] = client
+	}
+	return client
 }
 
-// NewClient creates a new Docker API client
-func NewClient() *Client {
+// NewClient creates a new Docker API client. endpoint is a unix socket such
+// as unix:///var/run/docker.sock or Podman's unix:///run/podman/podman.sock,
+// or a daemon listening on TCP as tcp://host:2375 or http://host:2375.
+func NewClient(endpoint string) *Client {
+	sharedMu.Lock()
+	limits := connLimits
+	sharedMu.Unlock()
+	return newClient(endpoint, limits)
+}
+
+func newClient(endpoint string, limits ConnLimits) *Client {
+	transport := &http.Transport{
+		// Every request goes to the one daemon, so the per-host idle
+		// limit (2 by default) would otherwise undercut MaxIdleConns
+		MaxIdleConns:        limits.MaxIdleConns,
+		MaxIdleConnsPerHost: limits.MaxIdleConns,
+		MaxConnsPerHost:     limits.MaxConnsPerHost,
+	}
+	baseURL := "http://localhost"
+	switch {
+	case strings.HasPrefix(endpoint, "tcp://"):
+		baseURL = "http://" + strings.TrimSuffix(strings.TrimPrefix(endpoint, "tcp://"), "/")
+	case strings.HasPrefix(endpoint, "http://"):
+		baseURL = strings.TrimSuffix(endpoint, "/")
+	default:
+		socketPath := strings.TrimPrefix(endpoint, "unix://")
+		transport.Dial = func(proto, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		}
+	}
 	return &Client{
 		httpClient: &http.Client{
-			Transport: &http.Transport{
-				Dial: func(proto, addr string) (net.Conn, error) {
-					return net.Dial("unix", "/var/run/docker.sock")
-				},
-			},
-			Timeout: 30 * time.Second,
+			Transport: transport,
+			Timeout:   30 * time.Second,
 		},
+		baseURL: baseURL,
 	}
 }
 
-// ListContainers returns a list of all containers
-func (c *Client) ListContainers() ([]Container, error) {
-	resp, err := c.httpClient.Get("http://localhost/containers/json")
+// get performs a GET against the API and decodes the JSON response into v
+func (c *Client) get(path string, v interface{}) error {
+	resp, err := c.httpClient.Get(c.baseURL + path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	var containers []Container
-	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Info represents the subset of the daemon's /info response used here
+type Info struct {
+	MemTotal          uint64 `json:"MemTotal"`
+	NCPU              int    `json:"NCPU"`
+	Containers        int    `json:"Containers"`
+	ContainersRunning int    `json:"ContainersRunning"`
+	ContainersPaused  int    `json:"ContainersPaused"`
+	ContainersStopped int    `json:"ContainersStopped"`
+	Images            int    `json:"Images"`
+}
+
+// Version represents the subset of the daemon's /version response used here
+type Version struct {
+	Version    string `json:"Version"`
+	APIVersion string `json:"ApiVersion"`
+}
+
+// GetInfo returns daemon-wide information
+func (c *Client) GetInfo() (*Info, error) {
+	var info Info
+	if err := c.get("/info", &info); err != nil {
 		return nil, err
 	}
+	return &info, nil
+}
 
-	return containers, nil
+// GetVersion returns the daemon's version information
+func (c *Client) GetVersion() (*Version, error) {
+	var version Version
+	if err := c.get("/version", &version); err != nil {
+		return nil, err
+	}
+	return &version, nil
 }
 
-// GetContainerStats returns statistics for a specific container
-func (c *Client) GetContainerStats(containerID string) (*Stats, error) {
-	url := fmt.Sprintf("http://localhost/containers/%s/stats?stream=false", containerID)
-	resp, err := c.httpClient.Get(url)
-	if err != nil {
+// ListContainers returns a list of all containers, including stopped ones.
+// Callers collecting every interval share one list per cycle: a list
+// fetched for the same interval less than interval ago is reused, and
+// callers must not modify it. A zero interval always lists afresh.
+func (c *Client) ListContainers(interval time.Duration) ([]Container, error) {
+	c.listMu.Lock()
+	defer c.listMu.Unlock()
+	if list, ok := c.lists[interval]; ok && time.Since(list.at) < interval {
+		return list.containers, nil
+	}
+	var containers []Container
+	if err := c.get("/containers/json?all=true", &containers); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	if c.lists == nil {
+		c.lists = make(map[time.Duration]containerList)
+	}
+	c.lists[interval] = containerList{containers: containers, at: time.Now()}
+	return containers, nil
+}
 
+// GetContainerStats returns statistics for a specific container
+func (c *Client) GetContainerStats(containerID string) (*Stats, error) {
 	var stats Stats
-	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+	if err := c.get(fmt.Sprintf("/containers/%s/stats?stream=false", containerID), &stats); err != nil {
 		return nil, err
 	}
-
 	return &stats, nil
 }
 
-// CalculateCPUPercentage calculates CPU usage from container stats
+// Name returns the container name without the leading slash, falling back to
+// the short ID when the runtime doesn't report a name
+func (c Container) Name() string {
+	if len(c.Names) > 0 && c.Names[0] != "" {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// CalculateCPUPercentage calculates CPU usage from container stats the way
+// the Docker CLI does, where one fully used core is 100%
 func CalculateCPUPercentage(stats *Stats) float64 {
+	return CalculateCPUCores(stats) * 100.0
+}
+
+// CalculateCPUCores calculates the number of cores a container used over the
+// sample interval, which compares across hosts with different CPU counts
+func CalculateCPUCores(stats *Stats) float64 {
+	// Podman and freshly started containers may omit precpu_stats entirely,
+	// in which case there is no previous sample to diff against
+	if stats.PreCPUStats.SystemCPUUsage == 0 || stats.CPUStats.SystemCPUUsage == 0 {
+		return 0.0
+	}
+
 	// Try to use PreCPU stats for delta calculation
 	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
 	systemDelta := float64(stats.CPUStats.SystemCPUUsage) - float64(stats.PreCPUStats.SystemCPUUsage)
@@ -188,98 +344,595 @@ func CalculateCPUPercentage(stats *Stats) float64 {
 		if numCPUs == 0 {
 			numCPUs = 1.0 // Fallback
 		}
-		cpuPercent := (cpuDelta / systemDelta) * numCPUs * 100.0
-		return cpuPercent
+		cpuCores := (cpuDelta / systemDelta) * numCPUs
+		if math.IsNaN(cpuCores) || math.IsInf(cpuCores, 0) {
+			return 0.0
+		}
+		return cpuCores
 	}
 
 	return 0.0 // No meaningful CPU usage detected
 }
 
-// StatsCollector collects Docker container statistics and sends them via callback
-func StatsCollector(dbAttributeName string, sleepTime int, recordEmptyOrZero bool, dataCallback func(string)) {
-	log.Printf("Docker stats collector started (sleep: %ds)", sleepTime)
-	client := NewClient()
+// missingCPUSection names the CPU section a usable cpu_percent needs but the
+// daemon left empty, or returns "" when both are there. Without precpu_stats
+// there is no earlier sample to diff against.
+func (s *Stats) missingCPUSection() string {
+	switch {
+	case s.CPUStats.SystemCPUUsage == 0 && s.CPUStats.CPUUsage.TotalUsage == 0:
+		return "cpu_stats"
+	case s.PreCPUStats.SystemCPUUsage == 0 && s.PreCPUStats.CPUUsage.TotalUsage == 0:
+		return "precpu_stats"
+	}
+	return ""
+}
+
+// hasMemoryStats reports whether the daemon sent a memory section
+func (s *Stats) hasMemoryStats() bool {
+	return s.MemoryStats.Usage != 0 || s.MemoryStats.Limit != 0
+}
+
+// IsMemoryLimited reports whether limit is a real container limit rather than
+// the host total or the cgroup "no limit" sentinel. hostMemory may be zero if
+// it couldn't be determined.
+func IsMemoryLimited(limit, hostMemory uint64) bool {
+	if limit == 0 || limit >= unlimitedMemorySentinel {
+		return false
+	}
+	if hostMemory > 0 && limit >= hostMemory {
+		return false
+	}
+	return true
+}
+
+// containerCounts summarises how many containers exist and how many run
+func containerCounts(measurement string, containers []Container) influx.Point {
+	running := 0
+	for _, container := range containers {
+		if container.State == "running" {
+			running++
+		}
+	}
+	return influx.Point{
+		Measurement: measurement,
+		Fields: map[string]interface{}{
+			"containers_total":   len(containers),
+			"containers_running": running,
+			"containers_stopped": len(containers) - running,
+		},
+		Time: time.Now(),
+	}
+}
+
+// sortedNetworks returns the container's interface names in order
+func sortedNetworks(stats *Stats) []string {
+	names := make([]string, 0, len(stats.Networks))
+	for name := range stats.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replicaSuffix matches the replica index Compose appends to container
+// names: app_web_1 with Compose v1, app-web-1 with v2
+var replicaSuffix = regexp.MustCompile(`[_-][0-9]+$`)
+
+// stoppedReadTime is the read timestamp the daemon reports in stats for a
+// container that isn't running
+const stoppedReadTime = "0001-01-01T00:00:00Z"
+
+// namedContainers builds placeholder containers for explicitly configured
+// names or IDs. The stats endpoint accepts either, so no listing is needed.
+func namedContainers(refs []string) []Container {
+	containers := make([]Container, 0, len(refs))
+	for _, ref := range refs {
+		containers = append(containers, Container{ID: ref, State: "running"})
+	}
+	return containers
+}
+
+// daemonInfo builds a point of daemon-wide metrics, tagged with the daemon
+// version when it can be determined
+func daemonInfo(client *Client, measurement string, info *Info) influx.Point {
+	point := influx.Point{
+		Measurement: measurement,
+		Fields: map[string]interface{}{
+			"containers":         info.Containers,
+			"containers_running": info.ContainersRunning,
+			"containers_paused":  info.ContainersPaused,
+			"containers_stopped": info.ContainersStopped,
+			"images":             info.Images,
+			"mem_total_bytes":    info.MemTotal,
+			"ncpu":               info.NCPU,
+		},
+		Time: time.Now(),
+	}
+	if version, err := client.GetVersion(); err == nil && version.Version != "" {
+		point.AddTag("docker_version", version.Version)
+	}
+	return point
+}
+
+// Options configures a StatsCollector
+type Options struct {
+	// Name is the measurement name and log prefix
+	Name string
+	// Endpoints are the daemon sockets to collect from. With more than one,
+	// points are tagged with their endpoint.
+	Endpoints         []string
+	SleepTime         int
+	RecordEmptyOrZero bool
+	// ContainerTagKey is the tag holding the container name
+	ContainerTagKey string
+	// Containers, when set, limits collection to these container names or
+	// IDs and skips listing every container each cycle
+	Containers []string
+	// StripReplicaSuffix removes a trailing Compose replica index from the
+	// container name tag
+	StripReplicaSuffix bool
+	// ContainerEvents emits a container_event point with state start or
+	// stop when a container begins or stops running between cycles
+	ContainerEvents bool
+	// ByteRates emits per-second network and block I/O rates, computed over
+	// the daemon's read timestamps between cycles, in place of the raw
+	// cumulative counters
+	ByteRates bool
+	// RawCounters keeps the cumulative byte counters alongside the rates
+	// when ByteRates is set
+	RawCounters bool
+	// StatsCallDelay is waited between consecutive per-container stats
+	// requests, trading collection latency for daemon load
+	StatsCallDelay time.Duration
+	// ContainerAsMeasurement writes each container's points to a measurement
+	// named after it, tagged insert with Name, instead of tagging the name
+	ContainerAsMeasurement bool
+	// NetworkPerInterface emits one extra point per network interface,
+	// tagged iface, instead of summing rx/tx across interfaces
+	NetworkPerInterface bool
+	// CPUCores adds cpu_cores, the absolute number of cores used, alongside
+	// cpu_percent
+	CPUCores bool
+	// InfoMeasurement, when set, receives daemon-wide /info metrics each cycle
+	InfoMeasurement string
+	// MetaMeasurement, when set, receives a container count summary each
+	// cycle, including how many containers points were written for
+	MetaMeasurement string
+	// MinCPUPercent and MinMemoryMB gate emission to busy containers. Zero
+	// disables a threshold. ThresholdMode "any" (default) emits when either
+	// enabled threshold is exceeded, "all" only when every one is.
+	MinCPUPercent float64
+	MinMemoryMB   float64
+	ThresholdMode string
+	// MemoryUnit is bytes, mb (default) or gb and sets the unit and name
+	// suffix of the memory_usage and memory_limit fields. MemoryDecimals,
+	// when set, rounds them.
+	MemoryUnit     string
+	MemoryDecimals *int
+	// Debug logs why fields were left out of a container's point
+	Debug bool
+}
+
+func (opts Options) debugf(format string, args ...interface{}) {
+	if opts.Debug {
+		log.Printf("DEBUG: [%s] "+format, append([]interface{}{opts.Name}, args...)...)
+	}
+}
+
+// containerSeries returns the measurement and tags for a container's points
+func (opts Options) containerSeries(containerName string) (string, map[string]string) {
+	if opts.ContainerAsMeasurement {
+		return strings.ReplaceAll(containerName, "-", "_"), map[string]string{"insert": opts.Name}
+	}
+	return opts.Name, map[string]string{opts.ContainerTagKey: containerName}
+}
+
+// memoryField converts a byte count to opts.MemoryUnit, returning the field
+// name suffix and value
+func (opts Options) memoryField(bytes uint64) (string, interface{}) {
+	var value float64
+	switch opts.MemoryUnit {
+	case "bytes":
+		return "bytes", bytes
+	case "gb":
+		value = float64(bytes) / 1024 / 1024 / 1024
+	default:
+		value = float64(bytes) / 1024 / 1024
+	}
+	if opts.MemoryDecimals != nil {
+		scale := math.Pow(10, float64(*opts.MemoryDecimals))
+		value = math.Round(value*scale) / scale
+	}
+	if opts.MemoryUnit == "gb" {
+		return "gb", value
+	}
+	return "mb", value
+}
+
+// exceedsThresholds reports whether a container's usage passes the configured
+// gates. cpuKnown is false when there is no CPU baseline yet and memoryKnown
+// when the stats had no memory section, in which case that threshold is
+// ignored.
+func (opts Options) exceedsThresholds(cpuPercent float64, cpuKnown bool, memoryMB float64, memoryKnown bool) bool {
+	var results []bool
+	if opts.MinCPUPercent > 0 && cpuKnown {
+		results = append(results, cpuPercent >= opts.MinCPUPercent)
+	}
+	if opts.MinMemoryMB > 0 && memoryKnown {
+		results = append(results, memoryMB >= opts.MinMemoryMB)
+	}
+	if len(results) == 0 {
+		return true
+	}
+	all := opts.ThresholdMode == "all"
+	for _, exceeded := range results {
+		if exceeded && !all {
+			return true
+		}
+		if !exceeded && all {
+			return false
+		}
+	}
+	return all
+}
+
+// StatsCollector collects Docker container statistics from every endpoint
+// and sends them via callback. A failing endpoint doesn't hold up the others.
+func StatsCollector(opts Options, dataCallback func(influx.Point)) {
+	if opts.ContainerTagKey == "" {
+		opts.ContainerTagKey = "container"
+	}
+	log.Printf("Docker stats collector started (endpoints: %s, sleep: %ds)", strings.Join(opts.Endpoints, ", "), opts.SleepTime)
+	var endpoints []*endpointState
+	for _, endpoint := range opts.Endpoints {
+		endpoints = append(endpoints, &endpointState{
+			endpoint: endpoint,
+			client:   SharedClient(endpoint),
+			seen:     make(map[string]bool),
+		})
+	}
 	firstRun := true
 
 	for {
 		if !firstRun {
-			time.Sleep(time.Duration(sleepTime) * time.Second)
+			time.Sleep(time.Duration(opts.SleepTime) * time.Second)
 		}
 		firstRun = false
 
-		// List all containers
-		containers, err := client.ListContainers()
-		if err != nil {
-			log.Printf("[%s] Failed to list containers: %v", dbAttributeName, err)
-			continue
+		for _, state := range endpoints {
+			emit := dataCallback
+			if len(endpoints) > 1 {
+				// Keep containers of different daemons apart
+				emit = func(point influx.Point) {
+					point.AddTag("endpoint", state.endpoint)
+					dataCallback(point)
+				}
+			}
+			state.collect(opts, emit)
 		}
+	}
+}
+
+// endpointState is what a StatsCollector keeps between cycles per endpoint
+type endpointState struct {
+	endpoint   string
+	client     *Client
+	hostMemory uint64
+	// containers observed in the previous cycle; a container's first stats
+	// read has no usable CPU baseline
+	seen map[string]bool
+	// byte counters from the previous cycle, for ByteRates
+	counters map[string]counterSample
+	// names of the containers running in the previous cycle, keyed by ID,
+	// for ContainerEvents. nil until the first cycle.
+	running map[string]string
+}
 
-		// Get stats for each container
-		for _, container := range containers {
-			if container.State != "running" {
-				continue // Skip stopped containers
+// collect runs one collection cycle against the endpoint
+func (state *endpointState) collect(opts Options, dataCallback func(influx.Point)) {
+	client := state.client
+	// Host memory is needed to recognise containers without a memory
+	// limit. Daemon info is refreshed every cycle when it is being recorded.
+	if state.hostMemory == 0 || opts.InfoMeasurement != "" {
+		info, err := client.GetInfo()
+		if err != nil {
+			log.Printf("[%s] Failed to get daemon info from %s: %v", opts.Name, state.endpoint, err)
+		} else {
+			state.hostMemory = info.MemTotal
+			if opts.InfoMeasurement != "" {
+				dataCallback(daemonInfo(client, opts.InfoMeasurement, info))
 			}
+		}
+	}
+
+	// List all containers, unless only named ones are collected and no
+	// summary of the whole daemon is wanted
+	var containers []Container
+	if len(opts.Containers) == 0 || opts.MetaMeasurement != "" {
+		var err error
+		containers, err = client.ListContainers(time.Duration(opts.SleepTime) * time.Second)
+		if err != nil {
+			log.Printf("[%s] Failed to list containers from %s: %v", opts.Name, state.endpoint, err)
+			return
+		}
+	}
+
+	listed := containers
+	if len(opts.Containers) > 0 {
+		containers = namedContainers(opts.Containers)
+	}
+
+	// Get stats for each container
+	current := make(map[string]bool)
+	counters := make(map[string]counterSample)
+	running := make(map[string]string)
+	requested := false
+	// containers a stats point was written for
+	matched := 0
+	for _, container := range containers {
+		if container.State != "running" {
+			continue // Skip stopped containers
+		}
+		// Spread the stats calls out so a large host doesn't burst the daemon
+		if requested && opts.StatsCallDelay > 0 {
+			time.Sleep(opts.StatsCallDelay)
+		}
+		requested = true
 
-			log.Printf("TRACE: Processing container %s with ID %s", container.Names[0], container.ID)
+		// Container name (remove leading slash)
+		containerName := container.Name()
 
-			stats, err := client.GetContainerStats(container.ID)
-			if err != nil {
-				log.Printf("[%s] Failed to get stats for container %s: %v", dbAttributeName, container.Names[0], err)
+		log.Printf("TRACE: Processing container %s with ID %s", containerName, container.ID)
+
+		stats, err := client.GetContainerStats(container.ID)
+		if err != nil {
+			log.Printf("[%s] Failed to get stats for container %s: %v", opts.Name, containerName, err)
+			// Keep its previous state rather than reporting a stop
+			if name, ok := state.running[container.ID]; ok {
+				running[container.ID] = name
+			}
+			continue
+		}
+		if len(opts.Containers) > 0 {
+			// Named containers weren't listed, so their state and name
+			// come from the stats response
+			if stats.Read == "" || stats.Read == stoppedReadTime {
 				continue
 			}
+			if stats.Name != "" {
+				containerName = strings.TrimPrefix(stats.Name, "/")
+			}
+		}
+		if opts.StripReplicaSuffix {
+			containerName = replicaSuffix.ReplaceAllString(containerName, "")
+		}
 
-			// Container name (remove leading slash)
-			containerName := strings.TrimPrefix(container.Names[0], "/")
-
-			// Calculate CPU percentage
-			cpuPercent := CalculateCPUPercentage(stats)
+		current[container.ID] = true
+		running[container.ID] = containerName
+		warmingUp := !state.seen[container.ID]
+
+		// Calculate CPU percentage. The deltas it uses span the daemon's own
+		// PreRead to Read window, which must be a real interval.
+		cpuPercent := CalculateCPUPercentage(stats)
+		readTime, interval, intervalKnown := sampleInterval(stats)
+		cpuKnown := !warmingUp
+		if cpuKnown && intervalKnown && interval <= 0 {
+			log.Printf("[%s] Skipping cpu_percent for container %s, sample interval is %v", opts.Name, containerName, interval)
+			cpuKnown = false
+		}
+		// Some runtimes, e.g. for Windows or just-started containers, send
+		// empty sections, which would otherwise come out as zeros
+		if section := stats.missingCPUSection(); cpuKnown && section != "" {
+			opts.debugf("Omitting cpu fields for container %s, %s is missing", containerName, section)
+			cpuKnown = false
+		}
+		memoryKnown := stats.hasMemoryStats()
+		if !memoryKnown {
+			opts.debugf("Omitting memory fields for container %s, memory_stats is missing", containerName)
+		}
 
-			// Calculate memory usage in MB (matching 'docker stats' behavior)
-			// Working Set = Total Usage - Inactive File (reclaimable cache)
-			totalUsage := stats.MemoryStats.Usage
-			inactiveFile := stats.MemoryStats.Stats.InactiveFile
-			workingSetUsage := totalUsage - inactiveFile
+		// Calculate memory usage in MB (matching 'docker stats' behavior)
+		// Working Set = Total Usage - Inactive File (reclaimable cache)
+		totalUsage := stats.MemoryStats.Usage
+		inactiveFile := min(stats.MemoryStats.Stats.InactiveFile, totalUsage)
+		workingSetUsage := totalUsage - inactiveFile
+
+		memoryUsageMB := float64(workingSetUsage) / 1024 / 1024 // This now matches 'docker stats'
+		memoryLimitMB := float64(stats.MemoryStats.Limit) / 1024 / 1024
+		memoryLimited := IsMemoryLimited(stats.MemoryStats.Limit, state.hostMemory)
+
+		// Calculate network I/O
+		var networkRxBytes, networkTxBytes uint64
+		for _, network := range stats.Networks {
+			networkRxBytes += network.RxBytes
+			networkTxBytes += network.TxBytes
+		}
 
-			memoryUsageMB := float64(workingSetUsage) / 1024 / 1024 // This now matches 'docker stats'
-			memoryLimitMB := float64(stats.MemoryStats.Limit) / 1024 / 1024
-			memoryPercent := 0.0
-			if memoryLimitMB > 0 {
-				memoryPercent = (memoryUsageMB / memoryLimitMB) * 100
+		// Calculate block I/O
+		var blockRead, blockWrite uint64
+		for _, bioEntry := range stats.BlkioStats.IoServiceBytesRecursive {
+			if bioEntry.Op == "read" || bioEntry.Op == "Read" {
+				blockRead += bioEntry.Value
+			} else if bioEntry.Op == "write" || bioEntry.Op == "Write" {
+				blockWrite += bioEntry.Value
 			}
+		}
 
-			// Calculate network I/O
-			var networkRxBytes, networkTxBytes uint64
-			for _, network := range stats.Networks {
-				networkRxBytes += network.RxBytes
-				networkTxBytes += network.TxBytes
+		// Counter samples are kept for containers below the thresholds too,
+		// so rates are available in the cycle one crosses them
+		var sample, prevSample counterSample
+		hasPrev := false
+		if opts.ByteRates {
+			sample = counterSample{read: readTime, networkRx: networkRxBytes, networkTx: networkTxBytes, blockRead: blockRead, blockWrite: blockWrite}
+			prevSample, hasPrev = state.counters[container.ID]
+			counters[container.ID] = sample
+		}
+
+		if !opts.exceedsThresholds(cpuPercent, cpuKnown, memoryUsageMB, memoryKnown) {
+			continue
+		}
+
+		// Prepare InfluxDB point
+		measurement, tags := opts.containerSeries(containerName)
+		point := influx.Point{
+			Measurement: measurement,
+			Tags:        tags,
+			Fields:      make(map[string]interface{}),
+			Time:        time.Now(),
+		}
+		rawCounters := !opts.ByteRates || opts.RawCounters
+		if rawCounters {
+			point.Fields["block_read_bytes"] = blockRead
+			point.Fields["block_write_bytes"] = blockWrite
+		}
+		if memoryKnown {
+			point.Fields["memory_limited"] = memoryLimited
+			unit, usage := opts.memoryField(workingSetUsage)
+			point.Fields["memory_usage_"+unit] = usage
+			_, limit := opts.memoryField(stats.MemoryStats.Limit)
+			point.Fields["memory_limit_"+unit] = limit
+		}
+		if warmingUp {
+			log.Printf("[%s] Skipping cpu_percent for newly observed container %s", opts.Name, containerName)
+		} else if cpuKnown {
+			point.Fields["cpu_percent"] = cpuPercent
+			if opts.CPUCores {
+				point.Fields["cpu_cores"] = CalculateCPUCores(stats)
 			}
+		}
 
-			// Calculate block I/O
-			var blockRead, blockWrite uint64
-			for _, bioEntry := range stats.BlkioStats.IoServiceBytesRecursive {
-				if bioEntry.Op == "read" || bioEntry.Op == "Read" {
-					blockRead += bioEntry.Value
-				} else if bioEntry.Op == "write" || bioEntry.Op == "Write" {
-					blockWrite += bioEntry.Value
-				}
+		// A percentage of the host total is misleading, so only report it
+		// for containers that actually have a limit
+		if memoryKnown && memoryLimited {
+			point.Fields["memory_percent"] = (memoryUsageMB / memoryLimitMB) * 100
+		}
+
+		if rawCounters && !opts.NetworkPerInterface {
+			point.Fields["network_rx_bytes"] = networkRxBytes
+			point.Fields["network_tx_bytes"] = networkTxBytes
+		}
+
+		if hasPrev {
+			sample.addRates(prevSample, point.Fields)
+		}
+
+		// Send data via callback
+		if len(point.Fields) == 0 {
+			opts.debugf("Skipping container %s, no stats sections to report", containerName)
+		} else {
+			dataCallback(point)
+			matched++
+		}
+
+		if opts.NetworkPerInterface {
+			for _, iface := range sortedNetworks(stats) {
+				network := stats.Networks[iface]
+				measurement, tags := opts.containerSeries(containerName)
+				tags["iface"] = iface
+				dataCallback(influx.Point{
+					Measurement: measurement,
+					Tags:        tags,
+					Fields: map[string]interface{}{
+						"network_rx_bytes": network.RxBytes,
+						"network_tx_bytes": network.TxBytes,
+					},
+					Time: point.Time,
+				})
+			}
+		}
+	}
+	state.seen = current
+	state.counters = counters
+	// Tells a selection or thresholds that match nothing apart from a
+	// collector that isn't running
+	if matched == 0 {
+		opts.debugf("No containers matched on %s, %d considered", state.endpoint, len(containers))
+	}
+	if opts.MetaMeasurement != "" {
+		meta := containerCounts(opts.MetaMeasurement, listed)
+		meta.Fields["containers_matched"] = matched
+		dataCallback(meta)
+	}
+	if opts.ContainerEvents {
+		// The first cycle only establishes what is already running
+		if state.running != nil {
+			for _, point := range containerEvents(opts.ContainerTagKey, state.running, running) {
+				dataCallback(point)
 			}
+		}
+		state.running = running
+	}
+}
+
+// containerEvents returns a container_event point for every container that
+// started or stopped running between two cycles
+func containerEvents(tagKey string, before, after map[string]string) []influx.Point {
+	var points []influx.Point
+	event := func(name, state string) {
+		points = append(points, influx.Point{
+			Measurement: "container_event",
+			Tags:        map[string]string{tagKey: name},
+			Fields:      map[string]interface{}{"state": state},
+			Time:        time.Now(),
+		})
+	}
+	for id, name := range after {
+		if _, ok := before[id]; !ok {
+			event(name, "start")
+		}
+	}
+	for id, name := range before {
+		if _, ok := after[id]; !ok {
+			event(name, "stop")
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Tags[tagKey] < points[j].Tags[tagKey]
+	})
+	return points
+}
 
-			// Prepare InfluxDB payload
-			payload := fmt.Sprintf("%s,container=%s cpu_percent=%f,memory_usage_mb=%f,memory_limit_mb=%f,memory_percent=%f,network_rx_bytes=%d,network_tx_bytes=%d,block_read_bytes=%d,block_write_bytes=%d",
-				dbAttributeName,
-				containerName,
-				cpuPercent,
-				memoryUsageMB,
-				memoryLimitMB,
-				memoryPercent,
-				networkRxBytes,
-				networkTxBytes,
-				blockRead,
-				blockWrite,
-			)
+// sampleInterval parses the stats read time and the window since the
+// daemon's previous read. ok is false when either timestamp is missing, as
+// with a container's first sample.
+func sampleInterval(stats *Stats) (read time.Time, interval time.Duration, ok bool) {
+	read, err := time.Parse(time.RFC3339Nano, stats.Read)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	preRead, err := time.Parse(time.RFC3339Nano, stats.PreRead)
+	if err != nil || preRead.IsZero() || stats.PreRead == stoppedReadTime {
+		return read, 0, false
+	}
+	return read, read.Sub(preRead), true
+}
+
+// counterSample holds a container's cumulative byte counters and the
+// daemon's read time for them, for ByteRates
+type counterSample struct {
+	read                                        time.Time
+	networkRx, networkTx, blockRead, blockWrite uint64
+}
 
-			// Send data via callback
-			dataCallback(payload)
+// addRates sets per-second rate fields from the change since prev, using
+// the daemon's read timestamps rather than the configured sleep. Rates are
+// left out when the interval isn't positive or a counter went backwards,
+// e.g. after a container restart.
+func (s counterSample) addRates(prev counterSample, fields map[string]interface{}) {
+	if s.read.IsZero() || prev.read.IsZero() {
+		return
+	}
+	seconds := s.read.Sub(prev.read).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	rate := func(name string, cur, old uint64) {
+		if cur >= old {
+			fields[name] = float64(cur-old) / seconds
 		}
 	}
+	rate("network_rx_bytes_per_s", s.networkRx, prev.networkRx)
+	rate("network_tx_bytes_per_s", s.networkTx, prev.networkTx)
+	rate("block_read_bytes_per_s", s.blockRead, prev.blockRead)
+	rate("block_write_bytes_per_s", s.blockWrite, prev.blockWrite)
 }
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplicaSuffix(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"app_web_1", "app_web"},
+		{"app-web-1", "app-web"},
+		{"app_web_12", "app_web"},
+		{"app-web-12", "app-web"},
+		// Not replica names
+		{"web1", "web1"},
+		{"app_web", "app_web"},
+		{"app-web", "app-web"},
+	}
+	for _, tt := range tests {
+		if got := replicaSuffix.ReplaceAllString(tt.name, ""); got != tt.want {
+			t.Errorf("%s stripped to %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListContainersShared(t *testing.T) {
+	var lists atomic.Int32
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lists.Add(1)
+		w.Write([]byte(`[{"Id":"abc","Names":["/web"],"State":"running"}]`))
+	}))
+	defer daemon.Close()
+	client := NewClient(daemon.URL)
+	interval := 5 * time.Second
+
+	// Two collectors on the same interval whose ticks have drifted apart
+	if _, err := client.ListContainers(interval); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := client.ListContainers(interval); err != nil {
+		t.Fatal(err)
+	}
+	if n := lists.Load(); n != 1 {
+		t.Fatalf("collectors offset within one interval listed %d times, want 1", n)
+	}
+
+	// A collector on another interval lists for itself
+	if _, err := client.ListContainers(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n := lists.Load(); n != 2 {
+		t.Fatalf("second interval group listed %d times in total, want 2", n)
+	}
+
+	// The next cycle lists afresh
+	client.listMu.Lock()
+	list := client.lists[interval]
+	list.at = list.at.Add(-interval)
+	client.lists[interval] = list
+	client.listMu.Unlock()
+	if _, err := client.ListContainers(interval); err != nil {
+		t.Fatal(err)
+	}
+	if n := lists.Load(); n != 3 {
+		t.Fatalf("next cycle listed %d times in total, want 3", n)
+	}
+}
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"regexp"
+	"scrape/influx"
+	"scrape/query"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"gopkg.in/yaml.v3"
+)
+
+// FieldConfig describes how a single field is extracted from a response. In
+// YAML a field may be given as a plain JSONPath string or as a mapping with
+// the options below.
+type FieldConfig struct {
+	Query      string           `yaml:"query"`
+	Delta      bool             `yaml:"delta"`
+	OnReset    string           `yaml:"onReset"`
+	Transforms []string         `yaml:"transforms"`
+	Compute    string           `yaml:"compute"`
+	ParseTime  *TimeParseConfig `yaml:"parseTime"`
+	// ParseDuration converts a duration such as 72h or 3d4h15m into seconds
+	ParseDuration bool `yaml:"parseDuration"`
+	// StoreBlank overrides the insert's storeBlank for this field when set
+	StoreBlank *bool `yaml:"storeBlank"`
+	// ExpectType is number, string or bool; mismatches are logged and
+	// optionally skipped so upstream format changes don't go unnoticed
+	ExpectType string `yaml:"expectType"`
+	// Exists records 1 when Query matches and 0 when it doesn't, whatever
+	// the matched value is
+	Exists bool `yaml:"exists"`
+	// Length records the number of characters in the matched value
+	Length bool `yaml:"length"`
+	// Expr is an expr-lang expression evaluated against the decoded JSON
+	// object, e.g. stats.used / stats.total * 100. Used instead of Query.
+	Expr string `yaml:"expr"`
+	// Fallbacks are tried in order when Query matches nothing, e.g. for
+	// paths that moved between upstream versions
+	Fallbacks []string `yaml:"fallbacks"`
+	// RecordMatchedPath tags the point with <field>_path, the index of the
+	// candidate that matched: 0 for Query, 1 for the first fallback, ...
+	RecordMatchedPath bool `yaml:"recordMatchedPath"`
+	// AbsentValue is used when no query matches at all, unlike the default
+	// transform, which also covers values that are present but empty
+	AbsentValue string `yaml:"absentValue"`
+	// ArrayMode decides what a query matching an array yields: first (the
+	// default), last, join, error or fanout. Overrides the insert's fanout
+	// and the global arrayMode.
+	ArrayMode string `yaml:"arrayMode"`
+	// ForceString always writes the value as a quoted string, even when it
+	// looks numeric, e.g. zip codes or version numbers
+	ForceString bool `yaml:"forceString"`
+	// RecordStaleness adds <field>_stale_seconds, the time since the value
+	// last changed, to spot frozen sensors repeating the same reading
+	RecordStaleness bool `yaml:"recordStaleness"`
+	// RecordChanged adds <field>_changed, 1 when the value differs from the
+	// previous cycle's and 0 when it doesn't
+	RecordChanged bool `yaml:"recordChanged"`
+
+	// compiled from Transforms, Compute and Expr when the config is loaded
+	transforms []query.Transform
+	compute    *query.Expression
+	program    *vm.Program
+}
+
+// TimeParseConfig converts a timestamp field into a number. Format is
+// rfc3339 (default), unix, or a Go time layout; Output is unix_s (default),
+// unix_ms or age_s.
+type TimeParseConfig struct {
+	Format string `yaml:"format"`
+	Output string `yaml:"output"`
+}
+
+// UnmarshalYAML accepts either a JSONPath scalar or a full field mapping
+func (f *FieldConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		f.Query = value.Value
+		return nil
+	}
+	type plain FieldConfig
+	return value.Decode((*plain)(f))
+}
+
+func (f FieldConfig) String() string {
+	if f.Compute != "" {
+		return "compute(" + f.Compute + ")"
+	}
+	if f.Expr != "" {
+		return "expr(" + f.Expr + ")"
+	}
+	return f.Query
+}
+
+// storeBlank reports whether empty or zero values of this field are kept
+func (f FieldConfig) storeBlank(config Config) bool {
+	if f.StoreBlank != nil {
+		return *f.StoreBlank
+	}
+	return config.RECORD_EMPTY_OR_ZERO
+}
+
+// compile validates the field options and prepares its transforms
+func (f *FieldConfig) compile() error {
+	if f.OnReset != "" && f.OnReset != "zero" && f.OnReset != "raw" {
+		return fmt.Errorf("invalid onReset %q, expected zero or raw", f.OnReset)
+	}
+	if f.ParseTime != nil && f.ParseTime.Output != "" && !query.ValidTimeOutput(f.ParseTime.Output) {
+		return fmt.Errorf("invalid parseTime output %q, expected unix_s, unix_ms or age_s", f.ParseTime.Output)
+	}
+	if f.ArrayMode != "" && !validArrayMode(f.ArrayMode) {
+		return fmt.Errorf("invalid arrayMode %q, expected first, last, join, error or fanout", f.ArrayMode)
+	}
+	if f.ParseTime != nil && f.ParseDuration {
+		return fmt.Errorf("parseTime and parseDuration can't both be set")
+	}
+	switch f.ExpectType {
+	case "", "number", "string", "bool":
+	default:
+		return fmt.Errorf("invalid expectType %q, expected number, string or bool", f.ExpectType)
+	}
+	if f.ForceString && f.ExpectType != "" && f.ExpectType != "string" {
+		return fmt.Errorf("forceString can't be used with expectType %s", f.ExpectType)
+	}
+	f.compute = nil
+	f.program = nil
+	switch {
+	case f.Expr != "" && (f.Query != "" || f.Compute != ""):
+		return fmt.Errorf("expr can't be used with query or compute")
+	case f.Expr != "" && (f.Exists || len(f.Fallbacks) > 0 || f.AbsentValue != ""):
+		return fmt.Errorf("exists, fallbacks and absentValue can't be used with expr")
+	case f.Expr != "":
+		program, err := expr.Compile(f.Expr)
+		if err != nil {
+			return fmt.Errorf("invalid expr: %v", err)
+		}
+		f.program = program
+	case f.Compute != "" && f.Query != "":
+		return fmt.Errorf("query and compute can't both be set")
+	case f.Compute != "" && (f.Exists || f.Length):
+		return fmt.Errorf("exists and length can't be used with compute")
+	case f.Exists && f.Length:
+		return fmt.Errorf("exists and length can't both be set")
+	case f.Compute != "" && len(f.Fallbacks) > 0:
+		return fmt.Errorf("fallbacks can't be used with compute")
+	case f.Compute != "" && (f.RecordStaleness || f.RecordChanged):
+		return fmt.Errorf("recordStaleness and recordChanged can't be used with compute")
+	case f.Compute != "":
+		expr, err := query.ParseExpression(f.Compute)
+		if err != nil {
+			return fmt.Errorf("invalid compute expression: %v", err)
+		}
+		f.compute = expr
+	case f.Query == "":
+		return fmt.Errorf("query is required")
+	}
+	for _, path := range f.candidates() {
+		if path == "" {
+			continue
+		}
+		if err := query.Validate(path); err != nil {
+			return fmt.Errorf("invalid JSONPath %s: %v", path, err)
+		}
+	}
+	f.transforms = nil
+	for _, spec := range f.Transforms {
+		transform, err := query.ParseTransform(spec)
+		if err != nil {
+			return err
+		}
+		f.transforms = append(f.transforms, transform)
+	}
+	return nil
+}
+
+// checkComputeReferences ensures computed fields only reference extracted
+// fields of the same insert
+func checkComputeReferences(fields map[string]FieldConfig) error {
+	for fieldName, field := range fields {
+		if field.compute == nil {
+			continue
+		}
+		for _, ref := range field.compute.Vars() {
+			target, ok := fields[ref]
+			if !ok {
+				return fmt.Errorf("field [%s] references unknown field [%s]", fieldName, ref)
+			}
+			if target.compute != nil {
+				return fmt.Errorf("field [%s] references computed field [%s]", fieldName, ref)
+			}
+		}
+	}
+	return nil
+}
+
+// computeField evaluates a computed field against the numeric values already
+// extracted into fields
+func computeField(field FieldConfig, fields map[string]interface{}) (string, error) {
+	vars := make(map[string]float64)
+	for _, ref := range field.compute.Vars() {
+		val, ok := fields[sanitize(ref)]
+		if !ok {
+			continue
+		}
+		if f, err := strconv.ParseFloat(fmt.Sprint(val), 64); err == nil {
+			vars[ref] = f
+		}
+	}
+	result, err := field.compute.Eval(vars)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'f', -1, 64), nil
+}
+
+// matchesType reports whether val would be written with the expected type
+func matchesType(val, expected string) bool {
+	_, numErr := strconv.ParseFloat(val, 64)
+	switch expected {
+	case "number":
+		return numErr == nil
+	case "bool":
+		_, err := strconv.ParseBool(val)
+		return err == nil
+	default:
+		return numErr != nil
+	}
+}
+
+// dropNonNumeric removes fields that don't parse as numbers, so a field that
+// is occasionally a string can't cause a type conflict in InfluxDB. Fields
+// with forceString are always strings and are dropped too.
+func dropNonNumeric(config Config, point *influx.Point) {
+	for key, val := range point.Fields {
+		_, forced := val.(influx.String)
+		if _, err := strconv.ParseFloat(fmt.Sprint(val), 64); err != nil || forced {
+			log.Printf("[%s] Dropping non-numeric field [%s] : %q", config.DB_ATTRIBUTE_NAME, key, fmt.Sprint(val))
+			delete(point.Fields, key)
+		}
+	}
+}
+
+// replaceNonFinite handles NaN and infinite field values, which InfluxDB
+// rejects along with the rest of the write. They're replaced with
+// global.nonFiniteValue when set and dropped otherwise. It returns false if
+// no fields are left.
+func replaceNonFinite(config Config, point *influx.Point) bool {
+	for key, val := range point.Fields {
+		if _, ok := val.(influx.String); ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(fmt.Sprint(val), 64)
+		if err != nil || !(math.IsNaN(f) || math.IsInf(f, 0)) {
+			continue
+		}
+		if config.NON_FINITE_VALUE != "" {
+			point.Fields[key] = config.NON_FINITE_VALUE
+			continue
+		}
+		log.Printf("[%s] Dropping non-finite field [%s] : %v", config.DB_ATTRIBUTE_NAME, key, val)
+		delete(point.Fields, key)
+	}
+	return len(point.Fields) > 0
+}
+
+// enforceLimits applies MAX_FIELDS and MAX_TAGS to a point. With the skip
+// action an oversized point is dropped (returning false); with truncate the
+// extra fields or tags, in key order, are removed.
+func enforceLimits(config Config, point *influx.Point) bool {
+	if config.MAX_FIELDS > 0 && len(point.Fields) > config.MAX_FIELDS {
+		if config.LIMIT_ACTION == "skip" {
+			log.Printf("[%s] Skipping point with %d fields, maxFields is %d", config.DB_ATTRIBUTE_NAME, len(point.Fields), config.MAX_FIELDS)
+			return false
+		}
+		log.Printf("[%s] Truncating point from %d to %d fields", config.DB_ATTRIBUTE_NAME, len(point.Fields), config.MAX_FIELDS)
+		for _, key := range sortedKeys(point.Fields)[config.MAX_FIELDS:] {
+			delete(point.Fields, key)
+		}
+	}
+	if config.MAX_TAGS > 0 && len(point.Tags) > config.MAX_TAGS {
+		if config.LIMIT_ACTION == "skip" {
+			log.Printf("[%s] Skipping point with %d tags, maxTags is %d", config.DB_ATTRIBUTE_NAME, len(point.Tags), config.MAX_TAGS)
+			return false
+		}
+		log.Printf("[%s] Truncating point from %d to %d tags", config.DB_ATTRIBUTE_NAME, len(point.Tags), config.MAX_TAGS)
+		for _, key := range sortedKeys(point.Tags)[config.MAX_TAGS:] {
+			delete(point.Tags, key)
+		}
+	}
+	return true
+}
+
+// nameHashLength is the length of the _xxxxxxxx suffix nameHashSuffix adds
+const nameHashLength = 9
+
+// truncatedNames remembers which names have been reported as truncated, so
+// the log isn't repeated every cycle
+var truncatedNames sync.Map
+
+// truncateNames shortens the measurement and field keys of a point to
+// MAX_NAME_LENGTH bytes. Fields are handled in key order so that, without a
+// hash suffix, the last of several keys sharing a prefix wins consistently.
+func truncateNames(config Config, point *influx.Point) {
+	point.Measurement = truncateName(config, point.Measurement)
+	for _, key := range sortedKeys(point.Fields) {
+		short := truncateName(config, key)
+		if short == key {
+			continue
+		}
+		val := point.Fields[key]
+		delete(point.Fields, key)
+		point.Fields[short] = val
+	}
+}
+
+// truncateName cuts name to MAX_NAME_LENGTH bytes without splitting a UTF-8
+// character. With NAME_HASH_SUFFIX the end is replaced by a hash of the full
+// name, so names that share a long prefix stay distinct.
+func truncateName(config Config, name string) string {
+	if len(name) <= config.MAX_NAME_LENGTH {
+		return name
+	}
+	keep := config.MAX_NAME_LENGTH
+	suffix := ""
+	if config.NAME_HASH_SUFFIX {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		suffix = fmt.Sprintf("_%08x", h.Sum32())
+		keep -= len(suffix)
+	}
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	short := name[:keep] + suffix
+	if _, logged := truncatedNames.LoadOrStore(config.DB_ATTRIBUTE_NAME+"\x00"+name, true); !logged {
+		log.Printf("[%s] Truncating name longer than %d bytes : %s -> %s", config.DB_ATTRIBUTE_NAME, config.MAX_NAME_LENGTH, name, short)
+	}
+	return short
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fieldDelta converts a cumulative counter value into the change since the
+// previous cycle. The first observation has nothing to compare against and is
+// skipped. A negative delta means the counter was reset; onReset chooses
+// between emitting zero (default) or the raw post-reset value.
+func fieldDelta(previous map[string]float64, name, val, onReset string) (string, error) {
+	current, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return "", fmt.Errorf("value %q is not numeric", val)
+	}
+	prev, seen := previous[name]
+	previous[name] = current
+	if !seen {
+		return "", fmt.Errorf("no previous value yet")
+	}
+	delta := current - prev
+	if delta < 0 {
+		if onReset == "raw" {
+			delta = current
+		} else {
+			delta = 0
+		}
+	}
+	return strconv.FormatFloat(delta, 'f', -1, 64), nil
+}
+
+// valueChange is the last value seen for a field and when it changed to it
+type valueChange struct {
+	value string
+	at    time.Time
+}
+
+// fieldChange records val and returns the seconds since it last changed,
+// counting from the first time it was seen, along with "1" or "0" for
+// whether it differs from the previous cycle's value. changed is empty the
+// first time, when there's nothing to compare against.
+func fieldChange(changes map[string]valueChange, name, val string, now time.Time) (stale, changed string) {
+	last, seen := changes[name]
+	switch {
+	case !seen:
+	case last.value == val:
+		changed = "0"
+	default:
+		changed = "1"
+	}
+	if !seen || last.value != val {
+		last = valueChange{value: val, at: now}
+		changes[name] = last
+	}
+	return strconv.FormatFloat(now.Sub(last.at).Seconds(), 'f', -1, 64), changed
+}
+
+// validArrayMode reports whether mode is a supported arrayMode
+func validArrayMode(mode string) bool {
+	switch mode {
+	case "first", "last", "join", "error", "fanout":
+		return true
+	}
+	return false
+}
+
+// arrayMode returns how the field treats a query matching an array
+func (f FieldConfig) arrayMode(config Config) string {
+	switch {
+	case f.ArrayMode != "":
+		return f.ArrayMode
+	case config.FANOUT:
+		return "fanout"
+	case config.ARRAY_MODE != "":
+		return config.ARRAY_MODE
+	}
+	return "first"
+}
+
+// absentPath is the matched path index recorded when AbsentValue stood in for
+// a field whose queries all failed to match
+const absentPath = -2
+
+// absent reports whether none of the field's queries match data
+func (f FieldConfig) absent(data interface{}) bool {
+	for _, path := range f.candidates() {
+		if _, err := query.Resolve(data, path); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the field's query followed by its fallbacks
+func (f FieldConfig) candidates() []string {
+	return append([]string{f.Query}, f.Fallbacks...)
+}
+
+// fieldValue extracts the raw value of a field from data, trying each
+// candidate path in turn. It also returns the index of the candidate that
+// matched, or -1 if none did.
+func fieldValue(config Config, fieldName string, field FieldConfig, data interface{}) (string, int) {
+	if field.program != nil {
+		val, err := evalExpr(field.program, data, config.NUMBER_FORMAT)
+		if err != nil {
+			log.Printf("[%s] Skipping field [%s], expr failed : %v", config.DB_ATTRIBUTE_NAME, fieldName, err)
+			return "", -1
+		}
+		return val, 0
+	}
+	for i, path := range field.candidates() {
+		if field.Exists {
+			if _, err := query.Resolve(data, path); err == nil {
+				return "1", i
+			}
+			continue
+		}
+		val, err := collapseValue(data, path, field.arrayMode(config), config.NUMBER_FORMAT)
+		if err != nil {
+			log.Printf("[%s] Skipping field [%s] : %v", config.DB_ATTRIBUTE_NAME, fieldName, err)
+			return "", -1
+		}
+		if val != "" {
+			return val, i
+		}
+		debugEmpty(config, fieldName, path, data)
+	}
+	if field.Exists {
+		return "0", -1
+	}
+	if field.AbsentValue != "" && field.absent(data) {
+		return field.AbsentValue, absentPath
+	}
+	return "", -1
+}
+
+// fieldValues is fieldValue for fanout, returning every value matched by
+// the first candidate that matches anything
+func fieldValues(config Config, fieldName string, field FieldConfig, data interface{}) ([]string, int) {
+	if field.Exists || field.program != nil || field.arrayMode(config) != "fanout" {
+		val, matched := fieldValue(config, fieldName, field, data)
+		return []string{val}, matched
+	}
+	for i, path := range field.candidates() {
+		vals := query.ExtractValuesUsingJSONQuery(data, path, config.NUMBER_FORMAT)
+		for _, val := range vals {
+			if val != "" {
+				return vals, i
+			}
+		}
+		debugEmpty(config, fieldName, path, data)
+	}
+	if field.AbsentValue != "" && field.absent(data) {
+		return []string{field.AbsentValue}, absentPath
+	}
+	return query.ExtractValuesUsingJSONQuery(data, field.Query, config.NUMBER_FORMAT), -1
+}
+
+// evalExpr runs an expr field's program with the keys of the JSON object
+// data as its variables and renders the result like a matched value
+func evalExpr(program *vm.Program, data interface{}, numberFormat string) (string, error) {
+	env, ok := data.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("expr needs a JSON object, got %T", data)
+	}
+	result, err := expr.Run(program, env)
+	if err != nil {
+		return "", err
+	}
+	switch v := result.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return query.FormatNumber(v, numberFormat), nil
+	default:
+		return "", fmt.Errorf("expr returned %T, expected a number, string or bool", result)
+	}
+}
+
+// debugEmpty logs why path yielded no value: a path error such as a missing
+// key, or a match that isn't a string or number
+func debugEmpty(config Config, fieldName, path string, data interface{}) {
+	if !debugLogging {
+		return
+	}
+	value, err := query.Resolve(data, path)
+	switch {
+	case err != nil:
+		debugf("[%s] Field [%s] path %s : %v", config.DB_ATTRIBUTE_NAME, fieldName, path, err)
+	case value == "":
+		debugf("[%s] Field [%s] path %s matched an empty string", config.DB_ATTRIBUTE_NAME, fieldName, path)
+	default:
+		kind := fmt.Sprintf("%T", value)
+		switch value.(type) {
+		case nil:
+			kind = "null"
+		case map[string]interface{}:
+			kind = "object"
+		case []interface{}:
+			kind = "empty array"
+		}
+		debugf("[%s] Field [%s] path %s matched %s, which isn't a string or number", config.DB_ATTRIBUTE_NAME, fieldName, path, kind)
+	}
+}
+
+// collapseValue extracts the value at path, reducing an array match to a
+// single value according to mode
+func collapseValue(data interface{}, path, mode, numberFormat string) (string, error) {
+	if mode == "first" || mode == "fanout" {
+		return query.ExtractValueUsingJSONQuery(data, path, numberFormat), nil
+	}
+	value, err := query.Resolve(data, path)
+	if err != nil {
+		return "", nil
+	}
+	arr, ok := value.([]interface{})
+	if !ok {
+		return query.ExtractValueUsingJSONQuery(value, "$", numberFormat), nil
+	}
+	switch mode {
+	case "error":
+		return "", fmt.Errorf("%s matched an array of %d values", path, len(arr))
+	case "last":
+		if len(arr) == 0 {
+			return "", nil
+		}
+		return query.ExtractValueUsingJSONQuery(arr[len(arr)-1], "$", numberFormat), nil
+	default:
+		vals := make([]string, 0, len(arr))
+		for _, v := range arr {
+			vals = append(vals, query.ExtractValueUsingJSONQuery(v, "$", numberFormat))
+		}
+		return strings.Join(vals, ","), nil
+	}
+}
+
+// fieldRow holds the raw values for one point
+type fieldRow struct {
+	// id distinguishes rows of the same cycle so delta state doesn't mix
+	id     string
+	tags   map[string]string
+	values map[string]string
+	// paths holds the index of the candidate path each field matched
+	paths map[string]int
+}
+
+// measurementPlaceholder matches a {field} placeholder in a measurement
+var measurementPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// checkMeasurementTemplate ensures every placeholder in a measurement names an
+// extracted field, as computed values don't exist yet when it is resolved
+func checkMeasurementTemplate(measurement string, fields map[string]FieldConfig) error {
+	for _, match := range measurementPlaceholder.FindAllStringSubmatch(measurement, -1) {
+		field, ok := fields[match[1]]
+		if !ok || field.compute != nil {
+			return fmt.Errorf("placeholder %s must name an extracted field", match[0])
+		}
+	}
+	return nil
+}
+
+// resolveMeasurement fills the {field} placeholders in the insert's
+// measurement with the row's extracted values
+func resolveMeasurement(config Config, row fieldRow) (string, error) {
+	missing := ""
+	name := measurementPlaceholder.ReplaceAllStringFunc(config.MEASUREMENT, func(placeholder string) string {
+		val := row.values[placeholder[1:len(placeholder)-1]]
+		if val == "" && missing == "" {
+			missing = placeholder
+		}
+		return val
+	})
+	if missing != "" {
+		return "", fmt.Errorf("measurement placeholder %s has no value", missing)
+	}
+	return name, nil
+}
+
+// fromBase resolves the insert's from path once, so forEach and the field
+// queries can be written relative to it
+func fromBase(config Config, data interface{}) (interface{}, error) {
+	if config.FROM == "" {
+		return data, nil
+	}
+	base, err := query.Resolve(data, config.FROM)
+	if err != nil {
+		return nil, fmt.Errorf("root path %s did not resolve : %v", config.FROM, err)
+	}
+	return base, nil
+}
+
+// retryOnMissingDelay is the wait before re-fetching a response that was
+// missing a required field
+const retryOnMissingDelay = time.Second
+
+// missingFields returns the required fields that came back empty in any row
+func missingFields(config Config, data interface{}) []string {
+	if len(config.REQUIRED_FIELDS) == 0 {
+		return nil
+	}
+	var missing []string
+	rows := extractRows(config, data)
+	for _, name := range config.REQUIRED_FIELDS {
+		empty := len(rows) == 0
+		for _, row := range rows {
+			if row.values[name] == "" {
+				empty = true
+			}
+		}
+		if empty {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// extractRows evaluates every field query against data. Normally this yields
+// a single row. With forEach, the object at that path is iterated and the
+// fields are evaluated against each member, tagging the row with its key.
+func extractRows(config Config, data interface{}) []fieldRow {
+	if config.FOR_EACH == "" {
+		return extractRowsFrom(config, data, "", nil)
+	}
+
+	value, err := query.Resolve(data, config.FOR_EACH)
+	if err != nil {
+		log.Printf("[%s] forEach path %s did not match : %v", config.DB_ATTRIBUTE_NAME, config.FOR_EACH, err)
+		return nil
+	}
+	members, ok := value.(map[string]interface{})
+	if !ok {
+		log.Printf("[%s] forEach path %s is not an object", config.DB_ATTRIBUTE_NAME, config.FOR_EACH)
+		return nil
+	}
+	var rows []fieldRow
+	for _, key := range sortedKeys(members) {
+		rows = append(rows, extractRowsFrom(config, members[key], key, map[string]string{config.FOR_EACH_TAG: key})...)
+	}
+	return rows
+}
+
+// extractRowsFrom evaluates the field queries against data. With fanout,
+// queries matching several values (e.g. $[*].temp) produce one row per value,
+// and single-valued fields are repeated in each row. INDEX_TAG, when set,
+// tags each of those rows with its position.
+func extractRowsFrom(config Config, data interface{}, id string, tags map[string]string) []fieldRow {
+	fanout := false
+	for _, field := range config.FIELDS {
+		if field.compute == nil && field.arrayMode(config) == "fanout" {
+			fanout = true
+		}
+	}
+	if !fanout {
+		row := fieldRow{id: id, tags: tags, values: make(map[string]string), paths: make(map[string]int)}
+		for fieldName, field := range config.FIELDS {
+			if field.compute != nil {
+				continue
+			}
+			row.values[fieldName], row.paths[fieldName] = fieldValue(config, fieldName, field, data)
+		}
+		return []fieldRow{row}
+	}
+
+	values := make(map[string][]string)
+	paths := make(map[string]int)
+	count := 1
+	for fieldName, field := range config.FIELDS {
+		if field.compute != nil {
+			continue
+		}
+		values[fieldName], paths[fieldName] = fieldValues(config, fieldName, field, data)
+		if len(values[fieldName]) > count {
+			count = len(values[fieldName])
+		}
+	}
+	rows := make([]fieldRow, count)
+	for i := range rows {
+		rows[i] = fieldRow{id: fmt.Sprintf("%s[%d]", id, i), tags: tags, values: make(map[string]string), paths: paths}
+		if config.INDEX_TAG != "" {
+			rows[i].tags = map[string]string{config.INDEX_TAG: strconv.Itoa(i)}
+			for key, val := range tags {
+				rows[i].tags[key] = val
+			}
+		}
+		for fieldName, vals := range values {
+			switch {
+			case len(vals) == 1:
+				rows[i].values[fieldName] = vals[0]
+			case i < len(vals):
+				rows[i].values[fieldName] = vals[i]
+			default:
+				rows[i].values[fieldName] = ""
+			}
+		}
+	}
+	return rows
+}
+
+// buildPoints extracts, filters and transforms the configured fields into
+// points. previous holds the delta state between cycles and changes the
+// staleness state.
+func buildPoints(config Config, data interface{}, previous map[string]float64, changes map[string]valueChange, timestamp time.Time) []influx.Point {
+	templated := measurementPlaceholder.MatchString(config.MEASUREMENT)
+	var points []influx.Point
+	for _, row := range extractRows(config, data) {
+		measurement := config.MEASUREMENT
+		if templated {
+			resolved, err := resolveMeasurement(config, row)
+			if err != nil {
+				log.Printf("[%s] Skipping point, %v", config.DB_ATTRIBUTE_NAME, err)
+				continue
+			}
+			measurement = resolved
+		}
+		point := influx.Point{
+			Measurement: measurement,
+			Tags:        make(map[string]string),
+			Fields:      make(map[string]interface{}),
+			Time:        timestamp,
+		}
+		for key, val := range row.tags {
+			point.Tags[key] = val
+		}
+		for fieldName, field := range config.FIELDS {
+			if field.compute != nil {
+				continue
+			}
+			val := row.values[fieldName]
+			if field.Length {
+				val = strconv.Itoa(utf8.RuneCountInString(val))
+			}
+			if field.ParseTime != nil && val != "" {
+				parsed, err := query.ParseTime(val, field.ParseTime.Format, field.ParseTime.Output, timestamp)
+				if err != nil {
+					log.Printf("[%s] Skipping field [%s], unparseable time : %v", config.DB_ATTRIBUTE_NAME, fieldName, err)
+					continue
+				}
+				val = parsed
+			}
+			if field.ParseDuration && val != "" {
+				seconds, err := query.ParseDuration(val)
+				if err != nil {
+					log.Printf("[%s] Skipping field [%s], unparseable duration : %v", config.DB_ATTRIBUTE_NAME, fieldName, err)
+					continue
+				}
+				val = seconds
+			}
+			if len(field.transforms) > 0 {
+				transformed, err := query.ApplyTransforms(val, field.transforms)
+				if err != nil {
+					log.Printf("[%s] Skipping field [%s], transform failed : %v", config.DB_ATTRIBUTE_NAME, fieldName, err)
+					continue
+				}
+				val = transformed
+			}
+			if config.TAG_FIELDS[fieldName] {
+				if val != "" {
+					point.Tags[sanitize(fieldName)] = val
+				}
+				continue
+			}
+			// A missing path is the point of an exists field or an absentValue,
+			// and an empty value the point of a length field, so their zeros
+			// are kept. A delta field's zero is a counter reset and has to
+			// reach fieldDelta to replace the previous reading.
+			explicit := field.Exists || field.Length || field.Delta || row.paths[fieldName] == absentPath
+			if !explicit && !field.storeBlank(config) && (val == "" || val == "0") {
+				log.Printf("[%s] Skipping field [%s] with empty or zero value", config.DB_ATTRIBUTE_NAME, fieldName)
+				continue
+			}
+			// Staleness and changes follow the reading itself, not its delta
+			var stale, changed string
+			if field.RecordStaleness || field.RecordChanged {
+				stale, changed = fieldChange(changes, row.id+"/"+fieldName, val, timestamp)
+			}
+			if field.Delta {
+				delta, err := fieldDelta(previous, row.id+"/"+fieldName, val, field.OnReset)
+				if err != nil {
+					log.Printf("[%s] Skipping delta field [%s] : %v", config.DB_ATTRIBUTE_NAME, fieldName, err)
+					continue
+				}
+				val = delta
+			}
+			if field.ExpectType != "" && !field.ForceString && !matchesType(val, field.ExpectType) {
+				log.Printf("[%s] Field [%s] expected %s, got %q", config.DB_ATTRIBUTE_NAME, fieldName, field.ExpectType, val)
+				if config.TYPE_MISMATCH == "skip" {
+					continue
+				}
+			}
+			if field.RecordMatchedPath && row.paths[fieldName] >= 0 {
+				point.Tags[sanitize(fieldName)+"_path"] = strconv.Itoa(row.paths[fieldName])
+			}
+			if field.ForceString {
+				point.Fields[sanitize(fieldName)] = influx.String(val)
+			} else {
+				point.Fields[sanitize(fieldName)] = val
+			}
+			if field.RecordStaleness {
+				point.Fields[sanitize(fieldName)+"_stale_seconds"] = stale
+			}
+			if field.RecordChanged && changed != "" {
+				point.Fields[sanitize(fieldName)+"_changed"] = changed
+			}
+		}
+		if len(point.Fields) == 0 {
+			continue
+		}
+		for fieldName, field := range config.FIELDS {
+			if field.compute == nil {
+				continue
+			}
+			val, err := computeField(field, point.Fields)
+			if err != nil {
+				log.Printf("[%s] Skipping computed field [%s] : %v", config.DB_ATTRIBUTE_NAME, fieldName, err)
+				continue
+			}
+			point.Fields[sanitize(fieldName)] = val
+		}
+		if config.NUMERIC_ONLY {
+			dropNonNumeric(config, &point)
+			if len(point.Fields) == 0 {
+				continue
+			}
+		}
+		if config.URL_AS_TAG {
+			if host := sourceHost(config.GET_REQUEST_TARGET); host != "" {
+				point.Tags[config.URL_TAG_KEY] = host
+			}
+		}
+		if !enforceLimits(config, &point) {
+			continue
+		}
+		// Counted after maxFields, so it matches what is written
+		if config.RECORD_FIELD_COUNT {
+			point.Fields["field_count"] = len(point.Fields)
+		}
+		points = append(points, point)
+	}
+	return points
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBuildPointsArrayRoot(t *testing.T) {
+	body, err := os.ReadFile("testdata/array_root.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		DB_ATTRIBUTE_NAME: "sensors",
+		MEASUREMENT:       "sensors",
+		FANOUT:            true,
+		INDEX_TAG:         "index",
+		FIELDS: map[string]FieldConfig{
+			"value": {Query: "$[*].value"},
+			"name":  {Query: "$[*].name"},
+		},
+		TAG_FIELDS: map[string]bool{"name": true},
+	}
+	for name, field := range config.FIELDS {
+		if err := field.compile(); err != nil {
+			t.Fatalf("compile %s: %v", name, err)
+		}
+		config.FIELDS[name] = field
+	}
+	data, err := decodeBody(config, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := buildPoints(config, data, map[string]float64{}, map[string]valueChange{}, time.Unix(1714564800, 0))
+	want := []struct {
+		index, name, value string
+	}{
+		{"0", "sensor-a", "21.5"},
+		{"1", "sensor-b", "19"},
+		{"2", "sensor-c", "23.25"},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("got %d points, want %d: %v", len(points), len(want), points)
+	}
+	for i, w := range want {
+		p := points[i]
+		if p.Tags["index"] != w.index || p.Tags["name"] != w.name {
+			t.Errorf("point %d tags = %v, want index=%s name=%s", i, p.Tags, w.index, w.name)
+		}
+		if got := p.Fields["value"]; got != w.value {
+			t.Errorf("point %d value = %v, want %s", i, got, w.value)
+		}
+	}
+}
+
+func TestBuildPointsDeltaReset(t *testing.T) {
+	for _, tc := range []struct {
+		onReset string
+		want    []string
+	}{
+		// The first reading only primes the previous value
+		{"", []string{"", "0", "3"}},
+		{"raw", []string{"", "0", "3"}},
+	} {
+		field := FieldConfig{Query: "$.count", Delta: true, OnReset: tc.onReset}
+		if err := field.compile(); err != nil {
+			t.Fatal(err)
+		}
+		config := Config{
+			DB_ATTRIBUTE_NAME: "counter",
+			MEASUREMENT:       "counter",
+			FIELDS:            map[string]FieldConfig{"count": field},
+		}
+		previous := map[string]float64{}
+		changes := map[string]valueChange{}
+		for i, reading := range []string{"5", "0", "3"} {
+			data, err := decodeBody(config, []byte(`{"count": `+reading+`}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			points := buildPoints(config, data, previous, changes, time.Unix(1714564800+int64(i), 0))
+			var got string
+			if len(points) == 1 {
+				got, _ = points[0].Fields["count"].(string)
+			}
+			if got != tc.want[i] {
+				t.Errorf("onReset %q, reading %s: delta = %q, want %q", tc.onReset, reading, got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestFieldExpr(t *testing.T) {
+	bad := FieldConfig{Expr: "(stats.used +"}
+	if err := bad.compile(); err == nil {
+		t.Error("compiling an incomplete expr succeeded")
+	}
+
+	config := Config{
+		DB_ATTRIBUTE_NAME: "memory",
+		MEASUREMENT:       "memory",
+		FIELDS: map[string]FieldConfig{
+			"used_percent": {Expr: "(stats.used + stats.cached) / stats.total * 100"},
+			"healthy":      {Expr: `status == "ok" ? 1 : 0`},
+			"hosts":        {Expr: `join(map(hosts, .name), ",")`},
+		},
+	}
+	for name, field := range config.FIELDS {
+		if err := field.compile(); err != nil {
+			t.Fatalf("compile %s: %v", name, err)
+		}
+		config.FIELDS[name] = field
+	}
+	body := `{"status": "ok", "stats": {"used": 300, "cached": 100, "total": 800}, "hosts": [{"name": "a"}, {"name": "b"}]}`
+	data, err := decodeBody(config, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := buildPoints(config, data, map[string]float64{}, map[string]valueChange{}, time.Unix(1714564800, 0))
+	if len(points) != 1 {
+		t.Fatalf("got %d points, want 1: %v", len(points), points)
+	}
+	want := map[string]string{"used_percent": "50", "healthy": "1", "hosts": "a,b"}
+	for name, w := range want {
+		if got := points[0].Fields[name]; got != w {
+			t.Errorf("%s = %v, want %s", name, got, w)
+		}
+	}
+}
@@ -4,6 +4,8 @@ go 1.24.0
 
 require (
 	github.com/PaesslerAG/jsonpath v0.1.1
+	github.com/expr-lang/expr v1.17.8
+	github.com/influxdata/line-protocol/v2 v2.2.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health records successful writes for the /health endpoint
+var health = newHealthTracker(0, 0)
+
+type healthTracker struct {
+	mu            sync.Mutex
+	started       time.Time
+	startupGrace  time.Duration
+	healthyWindow time.Duration
+	lastSuccess   map[string]time.Time
+	// writes InfluxDB accepted with a partial-write warning
+	writeWarnings int
+	// buffered lines dropped for being older than global.maxBufferAge
+	staleDropped int
+	// scrape success ratio per insert with successWindow set
+	successRate map[string]float64
+}
+
+type healthResponse struct {
+	Status        string               `json:"status"`
+	LastSuccess   map[string]time.Time `json:"lastSuccess"`
+	WriteWarnings int                  `json:"writeWarnings"`
+	StaleDropped  int                  `json:"staleDropped"`
+	SuccessRate   map[string]float64   `json:"successRate,omitempty"`
+}
+
+func newHealthTracker(startupGrace, healthyWindow int) *healthTracker {
+	return &healthTracker{
+		started:       time.Now(),
+		startupGrace:  time.Duration(startupGrace) * time.Second,
+		healthyWindow: time.Duration(healthyWindow) * time.Second,
+		lastSuccess:   make(map[string]time.Time),
+		successRate:   make(map[string]float64),
+	}
+}
+
+func (h *healthTracker) recordSuccess(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess[name] = time.Now()
+}
+
+func (h *healthTracker) recordSuccessRate(name string, rate float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.successRate[name] = rate
+}
+
+func (h *healthTracker) recordWriteWarning() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeWarnings++
+}
+
+func (h *healthTracker) recordStaleDropped(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.staleDropped += n
+}
+
+// outcomeWindow holds the outcomes of an insert's last cycles, for
+// successWindow
+type outcomeWindow struct {
+	outcomes []bool
+	next     int
+	count    int
+}
+
+func newOutcomeWindow(size int) *outcomeWindow {
+	return &outcomeWindow{outcomes: make([]bool, size)}
+}
+
+// record adds a cycle's outcome, replacing the oldest once the window is
+// full, and returns the share of successful cycles in the window
+func (w *outcomeWindow) record(ok bool) float64 {
+	w.outcomes[w.next] = ok
+	w.next = (w.next + 1) % len(w.outcomes)
+	w.count = min(w.count+1, len(w.outcomes))
+	succeeded := 0
+	for _, outcome := range w.outcomes[:w.count] {
+		if outcome {
+			succeeded++
+		}
+	}
+	return float64(succeeded) / float64(w.count)
+}
+
+// status reports "healthy" when any insert has succeeded within the healthy
+// window (or ever, if no window is configured). Before the first success the
+// status is "starting" until the startup grace period ends.
+func (h *healthTracker) status() healthResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	resp := healthResponse{LastSuccess: make(map[string]time.Time, len(h.lastSuccess)), WriteWarnings: h.writeWarnings, StaleDropped: h.staleDropped}
+	if len(h.successRate) > 0 {
+		resp.SuccessRate = make(map[string]float64, len(h.successRate))
+		for name, rate := range h.successRate {
+			resp.SuccessRate[name] = rate
+		}
+	}
+	var freshest time.Time
+	for name, t := range h.lastSuccess {
+		resp.LastSuccess[name] = t
+		if t.After(freshest) {
+			freshest = t
+		}
+	}
+
+	switch {
+	case !freshest.IsZero() && (h.healthyWindow == 0 || time.Since(freshest) <= h.healthyWindow):
+		resp.Status = "healthy"
+	case freshest.IsZero() && time.Since(h.started) < h.startupGrace:
+		resp.Status = "starting"
+	default:
+		resp.Status = "unhealthy"
+	}
+	return resp
+}
+
+func (h *healthTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := h.status()
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "healthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func startHTTPServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/health", health)
+	mux.Handle("/snapshot", snapshot)
+	log.Printf("HTTP server listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("HTTP server stopped: %v", err)
+	}
+}
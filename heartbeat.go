@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"scrape/influx"
+	"strings"
+	"time"
+)
+
+// version and commit identify the build. Release builds set them with
+// -ldflags "-X main.version=<version> -X main.commit=<sha>".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// defaultHeartbeatInterval is how often the heartbeat point is written unless
+// overridden by global.heartbeatInterval
+const defaultHeartbeatInterval = 60
+
+// heartbeatConfig returns the Config the global.heartbeat measurement is
+// written with. It goes to the global database URL.
+func heartbeatConfig(global GlobalConfig) (Config, error) {
+	db, err := resolveDatabaseURL("", global)
+	if err != nil {
+		return Config{}, err
+	}
+	config := Config{
+		DATABASE_URL:           db,
+		DB_ATTRIBUTE_NAME:      global.Heartbeat,
+		UDP_MAX_DATAGRAM:       global.UDPMaxDatagramSize,
+		PRECISION:              outputPrecision(db, global.Precision),
+		HOSTNAME_TAG_KEY:       global.HostnameTag,
+		INFLUX_VERSION_TAG_KEY: global.InfluxVersionTag,
+	}
+	if config.HOSTNAME_TAG_KEY != "" {
+		config.HOSTNAME = scraperHostname()
+	}
+	return config, nil
+}
+
+// runHeartbeat writes a point tagged with the build version and commit every
+// interval seconds, so deploys show up on a timeline. The writes don't count
+// towards /health, which tracks the inserts.
+func runHeartbeat(config Config, interval, inserts int) {
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	started := time.Now()
+	for {
+		point := influx.Point{
+			Measurement: config.DB_ATTRIBUTE_NAME,
+			Tags:        map[string]string{"version": version, "commit": commit},
+			Fields: map[string]interface{}{
+				"uptime_s": int64(time.Since(started).Seconds()),
+				"inserts":  inserts,
+			},
+			Time: time.Now(),
+		}
+		payload := strings.Join(pointLines(config, []influx.Point{point}), "\n")
+		if err := writeData(config, payload); err != nil {
+			log.Printf("[%s] Failed to write heartbeat : %v", config.DB_ATTRIBUTE_NAME, err)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
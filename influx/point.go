@@ -0,0 +1,209 @@
+package influx
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point represents a single InfluxDB line protocol entry
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// String is a field value that is always written quoted, even when it looks
+// like a number
+type String string
+
+// AddTag sets a tag, creating the tag map if needed. Existing tags with the
+// same key are kept, so explicit tags take precedence.
+func (p *Point) AddTag(key, value string) {
+	if p.Tags == nil {
+		p.Tags = make(map[string]string)
+	}
+	if _, ok := p.Tags[key]; !ok {
+		p.Tags[key] = value
+	}
+}
+
+// ValidPrecision reports whether precision is one of the supported timestamp
+// precisions: ns, us, ms or s
+func ValidPrecision(precision string) bool {
+	switch precision {
+	case "ns", "us", "ms", "s":
+		return true
+	}
+	return false
+}
+
+// PrecisionUnit returns the duration of one tick of a timestamp in the given
+// precision
+func PrecisionUnit(precision string) time.Duration {
+	switch precision {
+	case "s":
+		return time.Second
+	case "ms":
+		return time.Millisecond
+	case "us":
+		return time.Microsecond
+	default:
+		return time.Nanosecond
+	}
+}
+
+// Timestamp formats t as an integer in the given precision
+func Timestamp(t time.Time, precision string) int64 {
+	switch precision {
+	case "s":
+		return t.Unix()
+	case "ms":
+		return t.UnixMilli()
+	case "us":
+		return t.UnixMicro()
+	default:
+		return t.UnixNano()
+	}
+}
+
+// Line renders the point as line protocol. Tags and fields are sorted by key
+// so the output is stable between cycles. The timestamp is written in the
+// given precision and omitted when Time is zero, letting the server assign it.
+func (p Point) Line(precision string) string {
+	var b strings.Builder
+	b.WriteString(escapeName(p.Measurement, ", "))
+	for _, key := range sortedKeys(p.Tags) {
+		// An empty tag key or value isn't valid line protocol
+		if key == "" || p.Tags[key] == "" {
+			continue
+		}
+		b.WriteString("," + escapeTag(key) + "=" + escapeTag(p.Tags[key]))
+	}
+	b.WriteString(" ")
+	fieldKeys := make([]string, 0, len(p.Fields))
+	for key := range p.Fields {
+		fieldKeys = append(fieldKeys, key)
+	}
+	sort.Strings(fieldKeys)
+	for i, key := range fieldKeys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(formatField(key, p.Fields[key]))
+	}
+	if !p.Time.IsZero() {
+		b.WriteString(" " + strconv.FormatInt(Timestamp(p.Time, precision), 10))
+	}
+	return b.String()
+}
+
+// Split divides a point with more than maxFields fields into several points
+// sharing the measurement, tags and timestamp. maxFields <= 0 disables it.
+func (p Point) Split(maxFields int) []Point {
+	if maxFields <= 0 || len(p.Fields) <= maxFields {
+		return []Point{p}
+	}
+	keys := make([]string, 0, len(p.Fields))
+	for key := range p.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var points []Point
+	for start := 0; start < len(keys); start += maxFields {
+		end := min(start+maxFields, len(keys))
+		part := Point{Measurement: p.Measurement, Tags: p.Tags, Fields: make(map[string]interface{}, end-start), Time: p.Time}
+		for _, key := range keys[start:end] {
+			part.Fields[key] = p.Fields[key]
+		}
+		points = append(points, part)
+	}
+	return points
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatField(name string, value interface{}) string {
+	name = escapeTag(name)
+	switch v := value.(type) {
+	case float64:
+		return fmt.Sprintf("%s=%g", name, v)
+	case int:
+		return fmt.Sprintf("%s=%d", name, v)
+	case int64:
+		return fmt.Sprintf("%s=%d", name, v)
+	case uint64:
+		return fmt.Sprintf("%s=%d", name, v)
+	case bool:
+		return fmt.Sprintf("%s=%t", name, v)
+	case String:
+		return fmt.Sprintf(`%s="%s"`, name, escapeQuotes(string(v)))
+	case string:
+		if plainNumber(v) {
+			return fmt.Sprintf("%s=%s", name, v)
+		}
+		return fmt.Sprintf(`%s="%s"`, name, escapeQuotes(v))
+	default:
+		// fallback to quoted string
+		str := fmt.Sprintf("%v", value)
+		return fmt.Sprintf(`%s="%s"`, name, escapeQuotes(str))
+	}
+}
+
+// plainNumber reports whether s can be written as an unquoted float. Strings
+// like "0x1p4", "Inf" or "1_000" that strconv accepts but InfluxDB doesn't
+// are left to be quoted.
+func plainNumber(s string) bool {
+	if s == "" || s[0] == '+' || strings.Trim(s, "0123456789.eE+-") != "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// escapeQuotes escapes a string field value. Backslashes are escaped too, or
+// a value ending in one would swallow the closing quote. Line breaks are
+// written as \n and \r, since a raw one would end the line.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// escapeTag escapes the characters that are significant in tag keys and
+// values and in field keys
+func escapeTag(s string) string {
+	return escapeName(s, ", =")
+}
+
+// escapeName escapes the special characters in a measurement, tag or field
+// key, which are not quoted. InfluxDB only unescapes the special characters
+// themselves, so other backslashes are written as is; a trailing one can't
+// be written at all, as it would escape the separator after the name. Line
+// breaks are written as \n and \r.
+func escapeName(s, special string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case strings.IndexByte(special, c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
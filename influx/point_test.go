@@ -0,0 +1,166 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+)
+
+// lineBreaks is how Line writes line breaks in names, which can't appear raw
+// in line protocol and are read back as written
+var lineBreaks = strings.NewReplacer("\n", `\n`, "\r", `\r`)
+
+// writable reports whether line protocol can hold name: valid UTF-8 without
+// control characters other than the line breaks Line escapes, and no
+// trailing backslash, which would escape the separator after it
+func writable(name string) bool {
+	if !utf8.ValidString(name) || strings.HasSuffix(name, `\`) {
+		return false
+	}
+	for _, r := range name {
+		if r != '\n' && r != '\r' && (r < 0x20 || r == 0x7f) {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzLine(f *testing.F) {
+	f.Add("cpu", "host", "server01", "value", "ok")
+	f.Add("my measurement", "tag,key", "a=b c", "field key", `say "hi"`)
+	f.Add(`back\slash`, `k\,`, `v\=w`, `f\\g`, `ends with \`)
+	f.Add("multi\nline", "k", "v\r\nw", "f", "line one\nline two\ttabbed")
+	f.Add("cpu", "", "orphan", "value", "ok")
+	f.Fuzz(func(t *testing.T, measurement, tagKey, tagValue, fieldKey, value string) {
+		// Points are always built with a measurement and field keys, and a
+		// leading # would turn the line into a comment. Values decoded from
+		// JSON are valid UTF-8.
+		if measurement == "" || fieldKey == "" || strings.HasPrefix(measurement, "#") || !utf8.ValidString(value) {
+			t.Skip()
+		}
+		for _, name := range []string{measurement, tagKey, tagValue, fieldKey} {
+			if !writable(name) {
+				t.Skip()
+			}
+		}
+		p := Point{
+			Measurement: measurement,
+			Tags:        map[string]string{tagKey: tagValue},
+			Fields:      map[string]interface{}{fieldKey: String(value)},
+			Time:        time.Unix(0, 1714564800000000000),
+		}
+		line := p.Line("ns")
+
+		dec := lineprotocol.NewDecoderWithBytes([]byte(line))
+		if !dec.Next() {
+			t.Fatalf("no line decoded from %q", line)
+		}
+		gotMeasurement, err := dec.Measurement()
+		if err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if got, want := string(gotMeasurement), lineBreaks.Replace(measurement); got != want {
+			t.Errorf("measurement = %q, want %q", got, want)
+		}
+
+		var tags [][2]string
+		for {
+			key, val, err := dec.NextTag()
+			if err != nil {
+				t.Fatalf("invalid line %q: %v", line, err)
+			}
+			if key == nil {
+				break
+			}
+			tags = append(tags, [2]string{string(key), string(val)})
+		}
+		switch {
+		case tagKey == "" || tagValue == "":
+			if len(tags) != 0 {
+				t.Errorf("tag with an empty key or value was written: %q", line)
+			}
+		case len(tags) != 1:
+			t.Errorf("decoded tags %q, want one", tags)
+		default:
+			if got, want := tags[0][0], lineBreaks.Replace(tagKey); got != want {
+				t.Errorf("tag key = %q, want %q", got, want)
+			}
+			if got, want := tags[0][1], lineBreaks.Replace(tagValue); got != want {
+				t.Errorf("tag value = %q, want %q", got, want)
+			}
+		}
+
+		key, val, err := dec.NextField()
+		if err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if got, want := string(key), lineBreaks.Replace(fieldKey); got != want {
+			t.Errorf("field key = %q, want %q", got, want)
+		}
+		if val.Kind() != lineprotocol.String {
+			t.Fatalf("field value is a %v, want a string", val.Kind())
+		}
+		// String field values keep their line breaks
+		if got := val.StringV(); got != value {
+			t.Errorf("field value = %q, want %q", got, value)
+		}
+		if key, _, err := dec.NextField(); err != nil || key != nil {
+			t.Fatalf("extra field %q in %q: %v", key, line, err)
+		}
+
+		ts, err := dec.Time(lineprotocol.Nanosecond, time.Time{})
+		if err != nil {
+			t.Fatalf("invalid timestamp in %q: %v", line, err)
+		}
+		if !ts.Equal(p.Time) {
+			t.Errorf("timestamp = %v, want %v", ts, p.Time)
+		}
+		if dec.Next() {
+			t.Fatalf("more than one line in %q", line)
+		}
+	})
+}
+
+// lineTimestamp returns the trailing timestamp of a rendered line
+func lineTimestamp(line string) string {
+	return line[strings.LastIndexByte(line, ' ')+1:]
+}
+
+func TestLineDistinctTimestamps(t *testing.T) {
+	first := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	points := []Point{
+		{Measurement: "m", Fields: map[string]interface{}{"v": 1}, Time: first},
+		{Measurement: "m", Fields: map[string]interface{}{"v": 2}, Time: first.Add(3 * time.Microsecond)},
+	}
+	a, b := lineTimestamp(points[0].Line("ns")), lineTimestamp(points[1].Line("ns"))
+	if a == b {
+		t.Fatalf("scrapes 3µs apart share timestamp %s", a)
+	}
+	if want := "1714564800000000000"; a != want {
+		t.Errorf("first timestamp = %s, want %s", a, want)
+	}
+	if want := "1714564800000003000"; b != want {
+		t.Errorf("second timestamp = %s, want %s", b, want)
+	}
+}
+
+func TestTimestampPrecision(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	tests := []struct {
+		precision string
+		want      int64
+	}{
+		{"ns", 1714564800123456789},
+		{"us", 1714564800123456},
+		{"ms", 1714564800123},
+		{"s", 1714564800},
+	}
+	for _, tt := range tests {
+		if got := Timestamp(ts, tt.precision); got != tt.want {
+			t.Errorf("Timestamp(%s) = %d, want %d", tt.precision, got, tt.want)
+		}
+	}
+}
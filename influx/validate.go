@@ -0,0 +1,58 @@
+package influx
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+)
+
+// ValidateLine parses a single line of line protocol with InfluxData's
+// decoder and returns an error describing the first problem found, so
+// malformed output can be caught before the server rejects the whole write
+// with a 400
+func ValidateLine(line string) error {
+	// The decoder reads whole batches, skipping blank lines and comments,
+	// so a line that would be one of those is rejected up front
+	if line == "" {
+		return fmt.Errorf("empty line")
+	}
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		return fmt.Errorf("line break at column %d", i+1)
+	}
+	if line[0] == '#' {
+		return fmt.Errorf("line is a comment")
+	}
+
+	dec := lineprotocol.NewDecoderWithBytes([]byte(line))
+	if !dec.Next() {
+		return fmt.Errorf("no line found")
+	}
+	if _, err := dec.Measurement(); err != nil {
+		return err
+	}
+	for {
+		key, _, err := dec.NextTag()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			break
+		}
+	}
+	for {
+		key, _, err := dec.NextField()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			break
+		}
+	}
+	// Nanoseconds accept any int64, so this only checks the timestamp is one
+	if _, err := dec.Time(lineprotocol.Nanosecond, time.Time{}); err != nil {
+		return err
+	}
+	return nil
+}
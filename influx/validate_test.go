@@ -0,0 +1,28 @@
+package influx
+
+import "testing"
+
+func TestValidateLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		valid bool
+	}{
+		{`cpu value=1 1714564800000000000`, true},
+		{`cpu,host=a\ b used=1i,free=2u,ok=t,name="x \"y\""`, true},
+		{"", false},
+		{"cpu value=1\ncpu value=2", false},
+		{`# cpu value=1`, false},
+		{`cpu`, false},
+		{`cpu,host= value=1`, false},
+		{`cpu,=a value=1`, false},
+		{`cpu value=`, false},
+		{`cpu value="unterminated`, false},
+		{`cpu value=1x`, false},
+		{`cpu value=1 abc`, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateLine(tt.line); (err == nil) != tt.valid {
+			t.Errorf("ValidateLine(%q) = %v, want valid %t", tt.line, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// decodeBody parses a response according to the insert's format: JSON by
+// default, or key=value text lines for format kv
+func decodeBody(config Config, body []byte) (interface{}, error) {
+	if config.RESPONSE_FORMAT == "kv" {
+		return parseKV(body), nil
+	}
+	var data interface{}
+	if err := json.Unmarshal(trimJSON(body), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON response : %v", err)
+	}
+	return data, nil
+}
+
+// parseKV reads lines of key=value or key: value into a flat map, splitting
+// at whichever separator comes first. Numeric values become numbers; blank
+// lines, lines starting with # and lines without a key are ignored, and a
+// repeated key keeps its last value.
+func parseKV(body []byte) map[string]interface{} {
+	data := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(trimJSON(body)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:sep])
+		val := strings.Trim(strings.TrimSpace(line[sep+1:]), `"`)
+		if key == "" {
+			continue
+		}
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			data[key] = f
+		} else {
+			data[key] = val
+		}
+	}
+	return data
+}
+
+// kvPath turns a bare key from a kv insert's fields into a JSONPath. Keys
+// often contain dots, so bracket notation is used. Queries that are already
+// JSONPath are left alone.
+func kvPath(key string) string {
+	if key == "" || strings.HasPrefix(key, "$") {
+		return key
+	}
+	return "$[" + strconv.Quote(key) + "]"
+}
@@ -0,0 +1,14 @@
+package main
+
+import "log"
+
+// debugLogging enables debug messages. Set from global.logLevel or the
+// LOG_LEVEL environment variable.
+var debugLogging bool
+
+// debugf logs only at the debug log level
+func debugf(format string, args ...interface{}) {
+	if debugLogging {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
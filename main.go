@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"runtime/debug"
 	"scrape/docker"
+	"scrape/influx"
 	"scrape/query"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,35 +28,225 @@ import (
 )
 
 type Config struct {
-	DATABASE_URL         string
-	GET_REQUEST_TARGET   string
-	SLEEP_TIME           int
-	DB_ATTRIBUTE_NAME    string
-	RECORD_EMPTY_OR_ZERO bool
-	FIELDS               map[string]string
-	IS_DOCKER_STATS      bool
-	DOCKER_ENDPOINT      string
+	DATABASE_URL                 string
+	GET_REQUEST_TARGET           string
+	METHOD                       string
+	REQUEST_BODY                 string
+	CONTENT_TYPE                 string
+	SLEEP_TIME                   int
+	DB_ATTRIBUTE_NAME            string
+	RECORD_EMPTY_OR_ZERO         bool
+	FIELDS                       map[string]FieldConfig
+	IS_DOCKER_STATS              bool
+	DOCKER_ENDPOINTS             []string
+	DOCKER_META_MEASUREMENT      string
+	DOCKER_INFO_MEASUREMENT      string
+	DOCKER_CONTAINERS            []string
+	DOCKER_NETWORK_PER_INTERFACE bool
+	DOCKER_CPU_CORES             bool
+	DOCKER_STRIP_REPLICA_SUFFIX  bool
+	DOCKER_CONTAINER_TAG_KEY     string
+	DOCKER_CONTAINER_MEASUREMENT bool
+	DOCKER_STATS_CALL_DELAY      int
+	DOCKER_BYTE_RATES            bool
+	DOCKER_RAW_COUNTERS          bool
+	DOCKER_CONTAINER_EVENTS      bool
+	DOCKER_MIN_CPU_PERCENT       float64
+	DOCKER_MIN_MEMORY_MB         float64
+	DOCKER_THRESHOLD_MODE        string
+	DOCKER_MEMORY_UNIT           string
+	DOCKER_MEMORY_DECIMALS       *int
+	UDP_MAX_DATAGRAM             int
+	PRECISION                    string
+	HOSTNAME_TAG_KEY             string
+	HOSTNAME                     string
+	INFLUX_VERSION_TAG_KEY       string
+	NON_FINITE_VALUE             string
+	VALIDATE_LINES               bool
+	NAME_TAGS                    map[string]string
+	MAX_LINE_FIELDS              int
+	MAX_FIELDS                   int
+	NUMERIC_ONLY                 bool
+	TYPE_MISMATCH                string
+	MAX_TAGS                     int
+	LIMIT_ACTION                 string
+	NUMBER_FORMAT                string
+	ARRAY_MODE                   string
+	RECORD_BODY_SIZE             bool
+	RAW_FIELD                    string
+	RAW_FIELD_MINIFY             bool
+	RAW_FIELD_MAX_BYTES          int
+	FORCE_HTTP1                  bool
+	RESPONSE_FORMAT              string
+	RECORD_SEQ                   bool
+	SUCCESS_WINDOW               int
+	RECORD_FIELD_COUNT           bool
+	URL_AS_TAG                   bool
+	URL_TAG_KEY                  string
+	FANOUT                       bool
+	INDEX_TAG                    string
+	MEASUREMENT                  string
+	ADD_NAME_TAG                 bool
+	REQUIRED_FIELDS              []string
+	RETRY_ON_MISSING             int
+	FROM                         string
+	FOR_EACH                     string
+	FOR_EACH_TAG                 string
+	TAG_FIELDS                   map[string]bool
+	SUPPRESS_INSECURE            bool
+	SKIP_BATCH                   bool
+	MAX_NAME_LENGTH              int
+	NAME_HASH_SUFFIX             bool
+	INITIAL_INTERVAL             int
+	INITIAL_DURATION             int
+	INSECURE_SKIP_VERIFY         bool
+	CA_CERTS                     *x509.CertPool
+	MAX_RETRIES                  int
+	INITIAL_BACKOFF              int
+}
+
+// GlobalConfig holds settings shared by every insert
+type GlobalConfig struct {
+	DatabaseURL        string `yaml:"database_url"`
+	UDPMaxDatagramSize int    `yaml:"udpMaxDatagramSize"`
+	Precision          string `yaml:"precision"`
+	ListenAddress      string `yaml:"listenAddress"`
+	StartupGrace       int    `yaml:"startupGrace"`
+	HealthyWindow      int    `yaml:"healthyWindow"`
+	OnDuplicate        string `yaml:"onDuplicate"`
+	MinInterval        int    `yaml:"minInterval"`
+	WritePath          string `yaml:"writePath"`
+	HostnameTag        string `yaml:"hostnameTag"`
+	InfluxVersionTag   string `yaml:"influxVersionTag"`
+	ArrayMode          string `yaml:"arrayMode"`
+	WriteTimeout       int    `yaml:"writeTimeout"`
+	Token              string `yaml:"token"`
+	TokenFile          string `yaml:"tokenFile"`
+	TokenCacheTTL      int    `yaml:"tokenCacheTtl"`
+	Org                string `yaml:"org"`
+	OrgID              string `yaml:"orgID"`
+	Bucket             string `yaml:"bucket"`
+	BufferDir          string `yaml:"bufferDir"`
+	MaxBufferSegments  int    `yaml:"maxBufferSegments"`
+	MaxBufferAge       int    `yaml:"maxBufferAge"`
+	FlushSchedule      string `yaml:"flushSchedule"`
+	WriteRetries       int    `yaml:"writeRetries"`
+	RetryBudget        int    `yaml:"retryBudget"`
+	NonFiniteValue     string `yaml:"nonFiniteValue"`
+	ValidateLines      bool   `yaml:"validateLineProtocol"`
+	MaxNameLength      int    `yaml:"maxNameLength"`
+	NameHashSuffix     bool   `yaml:"nameHashSuffix"`
+	NameTagRegex       string `yaml:"nameTagRegex"`
+	LogLevel           string `yaml:"logLevel"`
+	WriteContentType   string `yaml:"writeContentType"`
+	WriteAccept        string `yaml:"writeAccept"`
+	Heartbeat          string `yaml:"heartbeat"`
+	HeartbeatInterval  int    `yaml:"heartbeatInterval"`
+	DockerMaxIdleConns int    `yaml:"dockerMaxIdleConns"`
+	DockerMaxConns     int    `yaml:"dockerMaxConnsPerHost"`
+	Routing            routes `yaml:"routing"`
+}
+
+// endpointList is one Docker endpoint or a list of them
+type endpointList []string
+
+// UnmarshalYAML accepts either a single endpoint or a sequence
+func (e *endpointList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*e = endpointList{value.Value}
+		return nil
+	}
+	return value.Decode((*[]string)(e))
+}
+
+// InsertConfig is a single entry under insert in the YAML config
+type InsertConfig struct {
+	URL                     string                 `yaml:"url"`
+	Method                  string                 `yaml:"method"`
+	Body                    string                 `yaml:"body"`
+	ContentType             string                 `yaml:"contentType"`
+	Form                    map[string]string      `yaml:"form"`
+	WaitTime                int                    `yaml:"waitTime"`
+	InitialInterval         int                    `yaml:"initialInterval"`
+	InitialDuration         int                    `yaml:"initialDuration"`
+	StoreBlank              bool                   `yaml:"storeBlank"`
+	DatabaseURL             string                 `yaml:"databaseUrl"`
+	Fields                  map[string]FieldConfig `yaml:"fields"`
+	Query                   string                 `yaml:"query"`
+	Measurement             string                 `yaml:"measurement"`
+	AddNameTag              bool                   `yaml:"addNameTag"`
+	RequiredFields          []string               `yaml:"requiredFields"`
+	RetryOnMissing          int                    `yaml:"retryOnMissing"`
+	MaxRetries              int                    `yaml:"maxRetries"`
+	InitialBackoff          int                    `yaml:"initialBackoff"`
+	DockerStats             bool                   `yaml:"dockerStats"`
+	DockerEndpoint          endpointList           `yaml:"dockerEndpoint"`
+	URLAsTag                bool                   `yaml:"urlAsTag"`
+	URLTagKey               string                 `yaml:"urlTagKey"`
+	SuppressInsecureWarning bool                   `yaml:"suppressInsecureWarning"`
+	Fanout                  bool                   `yaml:"fanout"`
+	IndexTag                string                 `yaml:"indexTag"`
+	MaxLineFields           int                    `yaml:"maxLineFields"`
+	MaxFields               int                    `yaml:"maxFields"`
+	NumericOnly             bool                   `yaml:"numericOnly"`
+	OnTypeMismatch          string                 `yaml:"onTypeMismatch"`
+	MaxTags                 int                    `yaml:"maxTags"`
+	LimitAction             string                 `yaml:"limitAction"`
+	NumberFormat            string                 `yaml:"numberFormat"`
+	RecordBodySize          bool                   `yaml:"recordBodySize"`
+	RawField                string                 `yaml:"rawField"`
+	RawFieldMinify          bool                   `yaml:"rawFieldMinify"`
+	RawFieldMaxBytes        int                    `yaml:"rawFieldMaxBytes"`
+	ForceHTTP1              bool                   `yaml:"forceHttp1"`
+	InsecureSkipVerify      bool                   `yaml:"insecureSkipVerify"`
+	CACertFile              string                 `yaml:"caCertFile"`
+	Format                  string                 `yaml:"format"`
+	RecordSeq               bool                   `yaml:"recordSeq"`
+	SuccessWindow           int                    `yaml:"successWindow"`
+	RecordFieldCount        bool                   `yaml:"recordFieldCount"`
+	From                    string                 `yaml:"from"`
+	Root                    string                 `yaml:"root"`
+	ForEach                 string                 `yaml:"forEach"`
+	ForEachTag              string                 `yaml:"forEachTag"`
+	TagFields               []string               `yaml:"tagFields"`
+	MetaMeasurement         string                 `yaml:"metaMeasurement"`
+	DockerInfo              bool                   `yaml:"dockerInfo"`
+	InfoMeasurement         string                 `yaml:"infoMeasurement"`
+	Containers              []string               `yaml:"containers"`
+	NetworkPerInterface     bool                   `yaml:"networkPerInterface"`
+	CPUCores                bool                   `yaml:"cpuCores"`
+	StripReplicaSuffix      bool                   `yaml:"stripReplicaSuffix"`
+	ContainerTagKey         string                 `yaml:"containerTagKey"`
+	ContainerAsMeasurement  bool                   `yaml:"containerAsMeasurement"`
+	StatsCallDelay          int                    `yaml:"statsCallDelay"`
+	ByteRates               bool                   `yaml:"byteRates"`
+	RawCounters             bool                   `yaml:"rawCounters"`
+	ContainerEvents         bool                   `yaml:"containerEvents"`
+	MinCPUPercent           float64                `yaml:"minCpuPercent"`
+	MinMemoryMB             float64                `yaml:"minMemoryMb"`
+	ThresholdMode           string                 `yaml:"thresholdMode"`
+	MemoryUnit              string                 `yaml:"memoryUnit"`
+	MemoryDecimals          *int                   `yaml:"memoryDecimals"`
+	Batch                   *bool                  `yaml:"batch"`
 }
 
 type YAMLConfig struct {
-	Global struct {
-		DatabaseURL string `yaml:"database_url"`
-	} `yaml:"global"`
-	Insert map[string]struct {
-		URL            string            `yaml:"url"`
-		WaitTime       int               `yaml:"waitTime"`
-		StoreBlank     bool              `yaml:"storeBlank"`
-		DatabaseURL    string            `yaml:"databaseUrl"`
-		Fields         map[string]string `yaml:"fields"`
-		DockerStats    bool              `yaml:"dockerStats"`
-		DockerEndpoint string            `yaml:"dockerEndpoint"`
-	} `yaml:"insert"`
+	Global GlobalConfig            `yaml:"global"`
+	Insert map[string]InsertConfig `yaml:"insert"`
 }
 
 func main() {
-	fmt.Println("Starting...")
+	diagnoseName := flag.String("diagnose", "", "check connectivity of the named insert and exit")
+	selftest := flag.Bool("selftest", false, "write a test point to each database, read it back and exit")
+	flag.Parse()
+	fmt.Printf("Starting scrape %s (%s)...\n", version, commit)
+
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = "config.yaml"
+	}
 
-	configs, err := loadConfigsFromYAML("config.yaml")
+	configs, global, err := loadConfigsFromYAML(configPath)
 	if err != nil {
 		log.Fatalf("Error loading YAML config: %v", err)
 	}
@@ -57,39 +256,240 @@ func main() {
 		return
 	}
 
+	warnInsecureTargets(configs)
+
+	token := global.Token
+	if envToken := os.Getenv("INFLUXDB_TOKEN"); envToken != "" {
+		token = envToken
+	}
+	influxToken = newTokenProvider(token, global.TokenFile, global.TokenCacheTTL)
+
+	if global.WriteTimeout > 0 {
+		writeClient.Timeout = time.Duration(global.WriteTimeout) * time.Second
+	}
+
+	if global.WriteContentType != "" {
+		writeContentType = global.WriteContentType
+	}
+	writeAccept = global.WriteAccept
+
+	docker.SetConnLimits(docker.ConnLimits{
+		MaxIdleConns:    global.DockerMaxIdleConns,
+		MaxConnsPerHost: global.DockerMaxConns,
+	})
+	writeRoutes = global.Routing
+
+	if *diagnoseName != "" {
+		if !diagnose(configs, *diagnoseName) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *selftest {
+		if !selfTest(configs) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	health = newHealthTracker(global.StartupGrace, global.HealthyWindow)
+
+	if global.BufferDir != "" {
+		writeBuffer, err = newDiskBuffer(global.BufferDir, global.MaxBufferSegments, time.Duration(global.MaxBufferAge)*time.Second, global.Precision)
+		if err != nil {
+			log.Fatalf("Error setting up write buffer: %v", err)
+		}
+		go writeBuffer.drainLoop()
+	}
+
+	if global.WriteRetries > 0 {
+		writeRetries = newRetryBudget(global.WriteRetries, global.RetryBudget)
+	}
+
+	if global.FlushSchedule != "" {
+		sched, err := parseSchedule(global.FlushSchedule)
+		if err != nil {
+			log.Fatalf("Error in global.flushSchedule: %v", err)
+		}
+		writeBatch = newBatcher()
+		go writeBatch.run(sched)
+	}
+
+	if global.Heartbeat != "" {
+		heartbeat, err := heartbeatConfig(global)
+		if err != nil {
+			log.Fatalf("Error in global.heartbeat: %v", err)
+		}
+		go runHeartbeat(heartbeat, global.HeartbeatInterval, len(configs))
+	}
+
+	if global.ListenAddress != "" {
+		go startHTTPServer(global.ListenAddress)
+	}
+
 	for _, config := range configs {
+		run := jsonChecker
 		if config.IS_DOCKER_STATS {
-			go func(cfg Config) {
-				docker.StatsCollector(cfg.DB_ATTRIBUTE_NAME, cfg.SLEEP_TIME, cfg.RECORD_EMPTY_OR_ZERO, func(payload string) {
-					log.Printf("INSERT : [%s]", payload)
-					if err := postDataToInfluxDB(cfg.DATABASE_URL, payload); err != nil {
-						log.Printf("[%s] Failed to post Docker stats data: %v", cfg.DB_ATTRIBUTE_NAME, err)
-					}
-				})
-			}(config)
-		} else {
-			go jsonChecker(config)
+			run = collectDockerStats
 		}
+		go supervise(config, run)
 	}
 
 	select {}
 }
 
-func loadConfigsFromYAML(path string) ([]Config, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open YAML file: %v", err)
+// restartDelay is the pause before a panicked insert is restarted
+const restartDelay = 5 * time.Second
+
+// supervise runs an insert's collection loop, recovering from a panic so one
+// bad insert can't take the others down, and restarting it after a delay
+func supervise(config Config, run func(Config)) {
+	for {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[%s] Recovered from panic : %v\n%s", config.DB_ATTRIBUTE_NAME, r, debug.Stack())
+				}
+			}()
+			run(config)
+		}()
+		log.Printf("[%s] Restarting in %v", config.DB_ATTRIBUTE_NAME, restartDelay)
+		time.Sleep(restartDelay)
 	}
-	defer file.Close()
+}
 
-	var yconf YAMLConfig
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&yconf); err != nil {
-		return nil, fmt.Errorf("failed to decode YAML: %v", err)
+// collectDockerStats runs the Docker stats collector for an insert
+func collectDockerStats(cfg Config) {
+	opts := docker.Options{
+		Name:                   cfg.DB_ATTRIBUTE_NAME,
+		Endpoints:              cfg.DOCKER_ENDPOINTS,
+		SleepTime:              cfg.SLEEP_TIME,
+		RecordEmptyOrZero:      cfg.RECORD_EMPTY_OR_ZERO,
+		ContainerTagKey:        cfg.DOCKER_CONTAINER_TAG_KEY,
+		ContainerAsMeasurement: cfg.DOCKER_CONTAINER_MEASUREMENT,
+		StatsCallDelay:         time.Duration(cfg.DOCKER_STATS_CALL_DELAY) * time.Millisecond,
+		ByteRates:              cfg.DOCKER_BYTE_RATES,
+		RawCounters:            cfg.DOCKER_RAW_COUNTERS,
+		ContainerEvents:        cfg.DOCKER_CONTAINER_EVENTS,
+		MetaMeasurement:        cfg.DOCKER_META_MEASUREMENT,
+		InfoMeasurement:        cfg.DOCKER_INFO_MEASUREMENT,
+		Containers:             cfg.DOCKER_CONTAINERS,
+		NetworkPerInterface:    cfg.DOCKER_NETWORK_PER_INTERFACE,
+		CPUCores:               cfg.DOCKER_CPU_CORES,
+		StripReplicaSuffix:     cfg.DOCKER_STRIP_REPLICA_SUFFIX,
+		MinCPUPercent:          cfg.DOCKER_MIN_CPU_PERCENT,
+		MinMemoryMB:            cfg.DOCKER_MIN_MEMORY_MB,
+		ThresholdMode:          cfg.DOCKER_THRESHOLD_MODE,
+		MemoryUnit:             cfg.DOCKER_MEMORY_UNIT,
+		MemoryDecimals:         cfg.DOCKER_MEMORY_DECIMALS,
+		Debug:                  debugLogging,
+	}
+	docker.StatsCollector(opts, func(point influx.Point) {
+		snapshot.record(cfg.DB_ATTRIBUTE_NAME, []influx.Point{point})
+		lines := pointLines(cfg, []influx.Point{point})
+		if len(lines) == 0 {
+			return
+		}
+		payload := strings.Join(lines, "\n")
+		log.Printf("INSERT : [%s]", payload)
+		if err := submitData(cfg, payload); err != nil {
+			log.Printf("[%s] Failed to post Docker stats data: %v", cfg.DB_ATTRIBUTE_NAME, err)
+		}
+	})
+}
+
+func loadConfigsFromYAML(path string) ([]Config, GlobalConfig, error) {
+	yconf, err := readYAMLConfig(path)
+	if err != nil {
+		return nil, GlobalConfig{}, err
 	}
 
 	if yconf.Global.DatabaseURL == "" {
-		return nil, fmt.Errorf("global.database_url must be specified")
+		return nil, GlobalConfig{}, fmt.Errorf("global.database_url must be specified")
+	}
+
+	udpMaxDatagram := yconf.Global.UDPMaxDatagramSize
+	if udpMaxDatagram <= 0 {
+		udpMaxDatagram = defaultUDPMaxDatagram
+	}
+
+	if yconf.Global.WritePath != "" && !strings.HasPrefix(yconf.Global.WritePath, "/") {
+		return nil, GlobalConfig{}, fmt.Errorf("global.writePath must begin with /")
+	}
+
+	if orgID := os.Getenv("INFLUXDB_ORG_ID"); orgID != "" {
+		yconf.Global.OrgID = orgID
+	}
+	if yconf.Global.Org != "" && yconf.Global.OrgID != "" {
+		return nil, GlobalConfig{}, fmt.Errorf("global.org and global.orgID can't both be set")
+	}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		yconf.Global.LogLevel = level
+	}
+	switch strings.ToLower(yconf.Global.LogLevel) {
+	case "", "info":
+	case "debug":
+		debugLogging = true
+	default:
+		return nil, GlobalConfig{}, fmt.Errorf("global.logLevel must be info or debug")
+	}
+
+	if v := yconf.Global.NonFiniteValue; v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, GlobalConfig{}, fmt.Errorf("global.nonFiniteValue must be a finite number")
+		}
+	}
+
+	if yconf.Global.DockerMaxIdleConns < 0 || yconf.Global.DockerMaxConns < 0 {
+		return nil, GlobalConfig{}, fmt.Errorf("global.dockerMaxIdleConns and global.dockerMaxConnsPerHost can't be negative")
+	}
+
+	if yconf.Global.MaxNameLength < 0 {
+		return nil, GlobalConfig{}, fmt.Errorf("global.maxNameLength can't be negative")
+	}
+	if yconf.Global.NameHashSuffix && yconf.Global.MaxNameLength > 0 && yconf.Global.MaxNameLength <= nameHashLength {
+		return nil, GlobalConfig{}, fmt.Errorf("global.maxNameLength must be more than %d with nameHashSuffix", nameHashLength)
+	}
+
+	if err := yconf.Global.Routing.validate(); err != nil {
+		return nil, GlobalConfig{}, err
+	}
+
+	if yconf.Global.ArrayMode != "" && !validArrayMode(yconf.Global.ArrayMode) {
+		return nil, GlobalConfig{}, fmt.Errorf("global.arrayMode must be one of first, last, join, error or fanout")
+	}
+
+	hostname := ""
+	if yconf.Global.HostnameTag != "" {
+		hostname = scraperHostname()
+	}
+
+	minInterval := yconf.Global.MinInterval
+	if minInterval <= 0 {
+		minInterval = defaultMinInterval
+	}
+
+	// Nanosecond timestamps keep rapid scrapes of the same series from
+	// overwriting each other
+	precision := yconf.Global.Precision
+	if precision == "" {
+		precision = "ns"
+	}
+	if !influx.ValidPrecision(precision) {
+		return nil, GlobalConfig{}, fmt.Errorf("global.precision must be one of ns, us, ms or s")
+	}
+
+	var nameTagRegex *regexp.Regexp
+	if yconf.Global.NameTagRegex != "" {
+		nameTagRegex, err = regexp.Compile(yconf.Global.NameTagRegex)
+		if err != nil {
+			return nil, GlobalConfig{}, fmt.Errorf("global.nameTagRegex is invalid: %v", err)
+		}
+		if strings.Join(nameTagRegex.SubexpNames(), "") == "" {
+			return nil, GlobalConfig{}, fmt.Errorf("global.nameTagRegex must have a named capture group")
+		}
 	}
 
 	var configs []Config
@@ -100,21 +500,84 @@ func loadConfigsFromYAML(path string) ([]Config, error) {
 				log.Printf("[%s] Skipping invalid Docker stats config - invalid wait time", name)
 				continue
 			}
-			db := entry.DatabaseURL
-			if db == "" {
-				db = yconf.Global.DatabaseURL
+			infoMeasurement := ""
+			if entry.DockerInfo {
+				infoMeasurement = entry.InfoMeasurement
+				if infoMeasurement == "" {
+					infoMeasurement = name + "_info"
+				}
+			}
+			if entry.ThresholdMode != "" && entry.ThresholdMode != "any" && entry.ThresholdMode != "all" {
+				log.Printf("[%s] Skipping invalid Docker stats config - thresholdMode must be any or all", name)
+				continue
+			}
+			memoryUnit := entry.MemoryUnit
+			if memoryUnit == "" {
+				memoryUnit = "mb"
+			}
+			if memoryUnit != "bytes" && memoryUnit != "mb" && memoryUnit != "gb" {
+				log.Printf("[%s] Skipping invalid Docker stats config - memoryUnit must be bytes, mb or gb", name)
+				continue
+			}
+			if entry.MemoryDecimals != nil && *entry.MemoryDecimals < 0 {
+				log.Printf("[%s] Skipping invalid Docker stats config - memoryDecimals can't be negative", name)
+				continue
+			}
+			db, err := resolveDatabaseURL(entry.DatabaseURL, yconf.Global)
+			if err != nil {
+				log.Printf("[%s] Skipping config, %v", name, err)
+				continue
+			}
+			dockerEndpoints := []string(entry.DockerEndpoint)
+			if len(dockerEndpoints) == 0 {
+				dockerEndpoints = []string{"unix:///var/run/docker.sock"}
 			}
-			dockerEndpoint := entry.DockerEndpoint
-			if dockerEndpoint == "" {
-				dockerEndpoint = "unix:///var/run/docker.sock"
+			unsupported := ""
+			for _, endpoint := range dockerEndpoints {
+				if !strings.HasPrefix(endpoint, "unix://") && !strings.HasPrefix(endpoint, "tcp://") && !strings.HasPrefix(endpoint, "http://") {
+					unsupported = endpoint
+				}
+			}
+			if unsupported != "" {
+				log.Printf("[%s] Skipping Docker stats config - unsupported endpoint %s, expected unix://, tcp:// or http://", name, unsupported)
+				continue
 			}
 			config := Config{
-				DATABASE_URL:         db,
-				DB_ATTRIBUTE_NAME:    name,
-				SLEEP_TIME:           entry.WaitTime,
-				RECORD_EMPTY_OR_ZERO: entry.StoreBlank,
-				IS_DOCKER_STATS:      true,
-				DOCKER_ENDPOINT:      dockerEndpoint,
+				DATABASE_URL:                 db,
+				DB_ATTRIBUTE_NAME:            name,
+				SLEEP_TIME:                   clampInterval(name, entry.WaitTime, minInterval),
+				RECORD_EMPTY_OR_ZERO:         entry.StoreBlank,
+				IS_DOCKER_STATS:              true,
+				DOCKER_ENDPOINTS:             dockerEndpoints,
+				DOCKER_META_MEASUREMENT:      entry.MetaMeasurement,
+				DOCKER_INFO_MEASUREMENT:      infoMeasurement,
+				DOCKER_CONTAINERS:            entry.Containers,
+				DOCKER_NETWORK_PER_INTERFACE: entry.NetworkPerInterface,
+				DOCKER_CPU_CORES:             entry.CPUCores,
+				DOCKER_STRIP_REPLICA_SUFFIX:  entry.StripReplicaSuffix,
+				DOCKER_CONTAINER_TAG_KEY:     entry.ContainerTagKey,
+				DOCKER_CONTAINER_MEASUREMENT: entry.ContainerAsMeasurement,
+				DOCKER_STATS_CALL_DELAY:      entry.StatsCallDelay,
+				DOCKER_BYTE_RATES:            entry.ByteRates,
+				DOCKER_RAW_COUNTERS:          entry.RawCounters,
+				DOCKER_CONTAINER_EVENTS:      entry.ContainerEvents,
+				DOCKER_MIN_CPU_PERCENT:       entry.MinCPUPercent,
+				DOCKER_MIN_MEMORY_MB:         entry.MinMemoryMB,
+				DOCKER_THRESHOLD_MODE:        entry.ThresholdMode,
+				DOCKER_MEMORY_UNIT:           memoryUnit,
+				DOCKER_MEMORY_DECIMALS:       entry.MemoryDecimals,
+				UDP_MAX_DATAGRAM:             udpMaxDatagram,
+				PRECISION:                    outputPrecision(db, precision),
+				MAX_LINE_FIELDS:              entry.MaxLineFields,
+				HOSTNAME_TAG_KEY:             yconf.Global.HostnameTag,
+				HOSTNAME:                     hostname,
+				NAME_TAGS:                    nameTags(nameTagRegex, name),
+				INFLUX_VERSION_TAG_KEY:       yconf.Global.InfluxVersionTag,
+				NON_FINITE_VALUE:             yconf.Global.NonFiniteValue,
+				VALIDATE_LINES:               yconf.Global.ValidateLines,
+				SKIP_BATCH:                   entry.Batch != nil && !*entry.Batch,
+				MAX_NAME_LENGTH:              yconf.Global.MaxNameLength,
+				NAME_HASH_SUFFIX:             yconf.Global.NameHashSuffix,
 			}
 			config.printValues()
 			configs = append(configs, config)
@@ -124,121 +587,697 @@ func loadConfigsFromYAML(path string) ([]Config, error) {
 				log.Printf("[%s] Skipping invalid YAML config", name)
 				continue
 			}
-			if len(entry.Fields) == 0 {
+			if entry.Query != "" {
+				if len(entry.Fields) > 0 {
+					log.Printf("[%s] Skipping config, query and fields can't both be set", name)
+					continue
+				}
+				entry.Fields = map[string]FieldConfig{"value": {Query: entry.Query}}
+			}
+			if len(entry.Fields) == 0 && entry.RawField == "" {
 				log.Printf("[%s] Skipping config, no fields specified", name)
 				continue
 			}
-			db := entry.DatabaseURL
-			if db == "" {
-				db = yconf.Global.DatabaseURL
+			if _, ok := entry.Fields[entry.RawField]; ok {
+				log.Printf("[%s] Skipping config, rawField [%s] clashes with a field", name, entry.RawField)
+				continue
+			}
+			var caCerts *x509.CertPool
+			if entry.CACertFile != "" {
+				caCerts, err = loadCACerts(entry.CACertFile)
+				if err != nil {
+					log.Printf("[%s] Skipping config, invalid caCertFile : %v", name, err)
+					continue
+				}
+			}
+			initialBackoff := entry.InitialBackoff
+			if initialBackoff == 0 {
+				initialBackoff = defaultInitialBackoff
+			}
+			rawFieldMaxBytes := entry.RawFieldMaxBytes
+			if rawFieldMaxBytes <= 0 {
+				rawFieldMaxBytes = defaultRawFieldMaxBytes
+			}
+			switch entry.Format {
+			case "", "json":
+			case "kv":
+			default:
+				log.Printf("[%s] Skipping config, format must be json or kv", name)
+				continue
+			}
+			invalidField := false
+			for fieldName, field := range entry.Fields {
+				if entry.Format == "kv" {
+					// kv fields name keys directly
+					field.Query = kvPath(field.Query)
+					for i, fallback := range field.Fallbacks {
+						field.Fallbacks[i] = kvPath(fallback)
+					}
+				}
+				if err := field.compile(); err != nil {
+					log.Printf("[%s] Invalid options for field [%s] : %v", name, fieldName, err)
+					invalidField = true
+				}
+				entry.Fields[fieldName] = field
+			}
+			if err := checkComputeReferences(entry.Fields); err != nil {
+				log.Printf("[%s] Invalid compute field : %v", name, err)
+				invalidField = true
+			}
+			for _, required := range entry.RequiredFields {
+				field, ok := entry.Fields[required]
+				if !ok || field.compute != nil {
+					log.Printf("[%s] requiredFields entry [%s] must name an extracted field", name, required)
+					invalidField = true
+				}
+			}
+			if entry.RetryOnMissing < 0 {
+				log.Printf("[%s] retryOnMissing can't be negative", name)
+				invalidField = true
+			}
+			if entry.MaxRetries < 0 || entry.InitialBackoff < 0 {
+				log.Printf("[%s] maxRetries and initialBackoff can't be negative", name)
+				invalidField = true
+			}
+			if entry.SuccessWindow < 0 {
+				log.Printf("[%s] successWindow can't be negative", name)
+				invalidField = true
+			}
+			if err := checkMeasurementTemplate(entry.Measurement, entry.Fields); err != nil {
+				log.Printf("[%s] Invalid measurement : %v", name, err)
+				invalidField = true
+			}
+			if invalidField {
+				log.Printf("[%s] Skipping config, invalid field options", name)
+				continue
+			}
+			db, err := resolveDatabaseURL(entry.DatabaseURL, yconf.Global)
+			if err != nil {
+				log.Printf("[%s] Skipping config, %v", name, err)
+				continue
+			}
+			tagFields := make(map[string]bool)
+			for _, tagField := range entry.TagFields {
+				if _, ok := entry.Fields[tagField]; !ok {
+					log.Printf("[%s] Ignoring tagFields entry [%s], no such field", name, tagField)
+					continue
+				}
+				tagFields[tagField] = true
+			}
+			if entry.InitialInterval < 0 || entry.InitialDuration < 0 || (entry.InitialInterval > 0) != (entry.InitialDuration > 0) {
+				log.Printf("[%s] Skipping config, initialInterval and initialDuration must be set together", name)
+				continue
+			}
+			initialInterval := entry.InitialInterval
+			if initialInterval > 0 && initialInterval < minInterval {
+				log.Printf("[%s] initialInterval %ds is below the minimum interval, using %ds", name, initialInterval, minInterval)
+				initialInterval = minInterval
+			}
+			if entry.OnTypeMismatch != "" && entry.OnTypeMismatch != "warn" && entry.OnTypeMismatch != "skip" {
+				log.Printf("[%s] Skipping config, onTypeMismatch must be warn or skip", name)
+				continue
+			}
+			if entry.LimitAction != "" && entry.LimitAction != "truncate" && entry.LimitAction != "skip" {
+				log.Printf("[%s] Skipping config, limitAction must be truncate or skip", name)
+				continue
+			}
+			numberFormat := entry.NumberFormat
+			if numberFormat == "" {
+				numberFormat = "fixed"
+			}
+			if !query.ValidNumberFormat(numberFormat) {
+				log.Printf("[%s] Skipping config, numberFormat must be fixed, auto or scientific", name)
+				continue
+			}
+			method, requestBody, contentType, err := requestOptions(entry)
+			if err != nil {
+				log.Printf("[%s] Skipping config, %v", name, err)
+				continue
+			}
+			// root is another name for from, for APIs that wrap their payload
+			if entry.Root != "" {
+				if entry.From != "" {
+					log.Printf("[%s] Skipping config, root and from can't both be set", name)
+					continue
+				}
+				entry.From = entry.Root
+			}
+			if entry.From != "" && !strings.HasPrefix(entry.From, "$") {
+				log.Printf("[%s] Skipping config, from must be a JSONPath starting with $", name)
+				continue
+			}
+			invalidPath := false
+			for option, path := range map[string]string{"from": entry.From, "forEach": entry.ForEach} {
+				if path == "" {
+					continue
+				}
+				if err := query.Validate(path); err != nil {
+					log.Printf("[%s] Skipping config, invalid %s JSONPath %s: %v", name, option, path, err)
+					invalidPath = true
+				}
+			}
+			if invalidPath {
+				continue
+			}
+			forEachTag := entry.ForEachTag
+			if forEachTag == "" {
+				forEachTag = "key"
+			}
+			measurement := entry.Measurement
+			if measurement == "" {
+				measurement = name
+			}
+			urlTagKey := entry.URLTagKey
+			if urlTagKey == "" {
+				urlTagKey = "source"
 			}
 			config := Config{
-				DATABASE_URL:         db,
-				DB_ATTRIBUTE_NAME:    name,
-				GET_REQUEST_TARGET:   entry.URL,
-				SLEEP_TIME:           entry.WaitTime,
-				RECORD_EMPTY_OR_ZERO: entry.StoreBlank,
-				FIELDS:               entry.Fields,
-				IS_DOCKER_STATS:      false,
+				DATABASE_URL:           db,
+				DB_ATTRIBUTE_NAME:      name,
+				GET_REQUEST_TARGET:     entry.URL,
+				METHOD:                 method,
+				REQUEST_BODY:           requestBody,
+				CONTENT_TYPE:           contentType,
+				SLEEP_TIME:             clampInterval(name, entry.WaitTime, minInterval),
+				RECORD_EMPTY_OR_ZERO:   entry.StoreBlank,
+				FIELDS:                 entry.Fields,
+				IS_DOCKER_STATS:        false,
+				UDP_MAX_DATAGRAM:       udpMaxDatagram,
+				PRECISION:              outputPrecision(db, precision),
+				MAX_LINE_FIELDS:        entry.MaxLineFields,
+				HOSTNAME_TAG_KEY:       yconf.Global.HostnameTag,
+				HOSTNAME:               hostname,
+				NAME_TAGS:              nameTags(nameTagRegex, name),
+				INFLUX_VERSION_TAG_KEY: yconf.Global.InfluxVersionTag,
+				NON_FINITE_VALUE:       yconf.Global.NonFiniteValue,
+				VALIDATE_LINES:         yconf.Global.ValidateLines,
+				URL_AS_TAG:             entry.URLAsTag,
+				URL_TAG_KEY:            urlTagKey,
+				SUPPRESS_INSECURE:      entry.SuppressInsecureWarning,
+				FANOUT:                 entry.Fanout,
+				INDEX_TAG:              entry.IndexTag,
+				MAX_FIELDS:             entry.MaxFields,
+				NUMERIC_ONLY:           entry.NumericOnly,
+				TYPE_MISMATCH:          entry.OnTypeMismatch,
+				MAX_TAGS:               entry.MaxTags,
+				LIMIT_ACTION:           entry.LimitAction,
+				NUMBER_FORMAT:          numberFormat,
+				ARRAY_MODE:             yconf.Global.ArrayMode,
+				RECORD_BODY_SIZE:       entry.RecordBodySize,
+				RAW_FIELD:              entry.RawField,
+				RAW_FIELD_MINIFY:       entry.RawFieldMinify,
+				RAW_FIELD_MAX_BYTES:    rawFieldMaxBytes,
+				FORCE_HTTP1:            entry.ForceHTTP1,
+				INSECURE_SKIP_VERIFY:   entry.InsecureSkipVerify,
+				CA_CERTS:               caCerts,
+				RESPONSE_FORMAT:        entry.Format,
+				RECORD_SEQ:             entry.RecordSeq,
+				SUCCESS_WINDOW:         entry.SuccessWindow,
+				RECORD_FIELD_COUNT:     entry.RecordFieldCount,
+				MEASUREMENT:            measurement,
+				ADD_NAME_TAG:           entry.AddNameTag,
+				REQUIRED_FIELDS:        entry.RequiredFields,
+				RETRY_ON_MISSING:       entry.RetryOnMissing,
+				MAX_RETRIES:            entry.MaxRetries,
+				INITIAL_BACKOFF:        initialBackoff,
+				FROM:                   entry.From,
+				FOR_EACH:               entry.ForEach,
+				FOR_EACH_TAG:           forEachTag,
+				TAG_FIELDS:             tagFields,
+				SKIP_BATCH:             entry.Batch != nil && !*entry.Batch,
+				MAX_NAME_LENGTH:        yconf.Global.MaxNameLength,
+				NAME_HASH_SUFFIX:       yconf.Global.NameHashSuffix,
+				INITIAL_INTERVAL:       initialInterval,
+				INITIAL_DURATION:       entry.InitialDuration,
 			}
 			config.printValues()
 			configs = append(configs, config)
 		}
 	}
 
-	return configs, nil
+	// Defaults are filled in for writes that aren't tied to an insert
+	yconf.Global.UDPMaxDatagramSize = udpMaxDatagram
+	yconf.Global.Precision = precision
+	return configs, yconf.Global, nil
 }
 
-func jsonChecker(config Config) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-		Timeout: 3 * time.Second,
+// warnInsecureTargets logs a single startup warning naming every insert that
+// scrapes over plain HTTP, unless the insert opted out.
+func warnInsecureTargets(configs []Config) {
+	var insecure []string
+	for _, config := range configs {
+		if config.IS_DOCKER_STATS || config.SUPPRESS_INSECURE {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(config.GET_REQUEST_TARGET), "http://") {
+			insecure = append(insecure, config.DB_ATTRIBUTE_NAME)
+		}
+	}
+	if len(insecure) > 0 {
+		sort.Strings(insecure)
+		log.Printf("WARNING: the following inserts scrape unencrypted http:// targets: %s", strings.Join(insecure, ", "))
 	}
+}
+
+func jsonChecker(config Config) {
+	client := scrapeClient(config)
 
 	firstRun := true
+	// previous raw values of delta fields, keyed by row and field name
+	previous := make(map[string]float64)
+	// last values of recordStaleness and recordChanged fields, and when
+	// they changed
+	changes := make(map[string]valueChange)
+	// number of successful scrapes, for recordSeq
+	seq := 0
+	// measurement names written so far, tracked up to the warning threshold
+	measurements := make(map[string]bool)
+	// outcomes of recent cycles, for successWindow
+	var window *outcomeWindow
+	if config.SUCCESS_WINDOW > 0 {
+		window = newOutcomeWindow(config.SUCCESS_WINDOW)
+	}
+	recordOutcome := func(ok bool) float64 {
+		if window == nil {
+			return 0
+		}
+		rate := window.record(ok)
+		health.recordSuccessRate(config.DB_ATTRIBUTE_NAME, rate)
+		return rate
+	}
+
+	// initialInterval applies from when the loop starts, so a restart
+	// begins with the fast phase again
+	started := time.Now()
 
 	for {
 		if !firstRun {
-			time.Sleep(time.Duration(config.SLEEP_TIME) * time.Second)
+			interval := config.SLEEP_TIME
+			if config.INITIAL_INTERVAL > 0 && time.Since(started) < time.Duration(config.INITIAL_DURATION)*time.Second {
+				interval = config.INITIAL_INTERVAL
+			}
+			time.Sleep(time.Duration(interval) * time.Second)
 		}
 		firstRun = false
 
-		resp, err := client.Get(config.GET_REQUEST_TARGET)
-		if err != nil {
-			log.Printf("[%s] Failed to fetch data : %v", config.DB_ATTRIBUTE_NAME, err)
-			continue
+		body, data, err := fetchJSON(client, config)
+		// A required field can be briefly absent from an otherwise valid
+		// response, so re-fetch a few times before giving up on the cycle
+		for retry := 1; err == nil && retry <= config.RETRY_ON_MISSING; retry++ {
+			missing := missingFields(config, data)
+			if len(missing) == 0 {
+				break
+			}
+			log.Printf("[%s] Required fields %s missing, re-fetching (%d/%d)", config.DB_ATTRIBUTE_NAME, strings.Join(missing, ", "), retry, config.RETRY_ON_MISSING)
+			time.Sleep(retryOnMissingDelay)
+			body, data, err = fetchJSON(client, config)
 		}
-
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
 		if err != nil {
-			log.Printf("[%s] Failed to read response body - %v", config.DB_ATTRIBUTE_NAME, err)
+			log.Printf("[%s] Scrape failed, %v", config.DB_ATTRIBUTE_NAME, err)
+			recordOutcome(false)
 			continue
 		}
-
-		var data interface{}
-		if err := json.Unmarshal(body, &data); err != nil {
-			log.Printf("[%s] Failed to parse JSON response : %v", config.DB_ATTRIBUTE_NAME, err)
+		if missing := missingFields(config, data); len(missing) > 0 {
+			log.Printf("[%s] Skipping cycle, required fields %s missing", config.DB_ATTRIBUTE_NAME, strings.Join(missing, ", "))
+			recordOutcome(false)
 			continue
 		}
 
-		fields := make(map[string]string)
-		for fieldName, jq := range config.FIELDS {
-			val := query.ExtractValueUsingJSONQuery(data, jq)
-			if !config.RECORD_EMPTY_OR_ZERO && (val == "" || val == "0") {
-				log.Printf("[%s] Skipping field [%s] with empty or zero value", config.DB_ATTRIBUTE_NAME, fieldName)
-				continue
-			}
-			fields[fieldName] = val
+		now := time.Now()
+		points := buildPoints(config, data, previous, changes, now)
+		if len(config.FIELDS) == 0 {
+			// An insert with only rawField archives the response as is
+			points = []influx.Point{{Measurement: config.MEASUREMENT, Tags: make(map[string]string), Fields: make(map[string]interface{}), Time: now}}
 		}
-
-		if len(fields) == 0 {
+		raw, hasRaw := rawFieldValue(config, body)
+		if len(points) == 0 || (len(config.FIELDS) == 0 && !hasRaw) {
 			log.Printf("[%s] No valid fields to insert", config.DB_ATTRIBUTE_NAME)
+			recordOutcome(false)
 			continue
 		}
+		seq++
+		rate := recordOutcome(true)
+		for _, point := range points {
+			if len(measurements) < measurementCardinalityWarning && !measurements[point.Measurement] {
+				measurements[point.Measurement] = true
+				if len(measurements) == measurementCardinalityWarning {
+					log.Printf("[%s] Warning: measurement has resolved to %d different names, check its placeholders aren't high cardinality", config.DB_ATTRIBUTE_NAME, len(measurements))
+				}
+			}
+		}
+		for _, point := range points {
+			if config.RECORD_BODY_SIZE {
+				point.Fields["response_bytes"] = len(body)
+			}
+			if config.RECORD_SEQ {
+				point.Fields["seq"] = seq
+			}
+			if window != nil {
+				point.Fields["success_rate"] = rate
+			}
+			if hasRaw {
+				point.Fields[config.RAW_FIELD] = influx.String(raw)
+			}
+			if config.ADD_NAME_TAG {
+				point.AddTag("name", config.DB_ATTRIBUTE_NAME)
+			}
+		}
 
-		payload := config.DB_ATTRIBUTE_NAME + " "
-		for key, val := range fields {
-			payload += formatField(sanitize(key), val) + ","
+		snapshot.record(config.DB_ATTRIBUTE_NAME, points)
+		lines := pointLines(config, points)
+		if len(lines) == 0 {
+			log.Printf("[%s] No valid lines to insert", config.DB_ATTRIBUTE_NAME)
+			continue
 		}
-		payload = strings.TrimSuffix(payload, ",")
+		payload := strings.Join(lines, "\n")
 		log.Printf("INSERT : [%s]", payload)
-		if err := postDataToInfluxDB(config.DATABASE_URL, payload); err != nil {
+		if err := submitData(config, payload); err != nil {
 			log.Printf("[%s] Failed to post data : %v", config.DB_ATTRIBUTE_NAME, err)
 		}
 	}
 }
 
-func formatField(name string, value interface{}) string {
-	switch v := value.(type) {
-	case float64:
-		return fmt.Sprintf("%s=%g", name, v)
-	case int:
-		return fmt.Sprintf("%s=%d", name, v)
-	case string:
-		if _, err := strconv.ParseFloat(v, 64); err == nil {
-			return fmt.Sprintf("%s=%s", name, v)
-		}
-		return fmt.Sprintf(`%s="%s"`, name, escapeQuotes(v))
-	default:
-		// fallback to quoted string
-		str := fmt.Sprintf("%v", value)
-		return fmt.Sprintf(`%s="%s"`, name, escapeQuotes(str))
+// measurementCardinalityWarning is the number of distinct names a templated
+// measurement can resolve to before a warning is logged
+const measurementCardinalityWarning = 100
+
+// defaultRawFieldMaxBytes keeps rawField within InfluxDB's 64 KiB string
+// field limit unless overridden by rawFieldMaxBytes
+const defaultRawFieldMaxBytes = 65535
+
+// rawFieldValue returns the response body for rawField, minified if
+// configured. Bodies over the size cap are left out rather than truncated
+// into invalid JSON.
+func rawFieldValue(config Config, body []byte) (string, bool) {
+	if config.RAW_FIELD == "" {
+		return "", false
+	}
+	raw := trimJSON(body)
+	if config.RAW_FIELD_MINIFY {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, raw); err == nil {
+			raw = compact.Bytes()
+		}
+	}
+	if len(raw) > config.RAW_FIELD_MAX_BYTES {
+		log.Printf("[%s] Skipping rawField [%s], %d bytes is over the %d byte cap", config.DB_ATTRIBUTE_NAME, config.RAW_FIELD, len(raw), config.RAW_FIELD_MAX_BYTES)
+		return "", false
+	}
+	return string(raw), true
+}
+
+// fetchJSON fetches and parses an insert's target, re-rooting the result at
+// its from path
+func fetchJSON(client *http.Client, config Config) ([]byte, interface{}, error) {
+	body, err := fetchWithRetries(client, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch data : %v", err)
+	}
+	data, err := decodeBody(config, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = fromBase(config, data)
+	if err != nil {
+		return nil, nil, err
 	}
+	return body, data, nil
 }
 
-func escapeQuotes(s string) string {
-	return strings.ReplaceAll(s, `"`, `\"`)
+// scrapeClient returns the HTTP client used to fetch an insert's target
+func scrapeClient(config Config) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.INSECURE_SKIP_VERIFY,
+			RootCAs:            config.CA_CERTS,
+		},
+		// A custom TLS config turns off HTTP/2 unless it's asked for
+		ForceAttemptHTTP2: true,
+	}
+	if config.FORCE_HTTP1 {
+		// A non-nil, empty TLSNextProto disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   3 * time.Second,
+	}
+}
+
+// utf8BOM is prepended to responses by some .NET and Windows-hosted APIs
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// trimJSON strips a leading UTF-8 byte order mark and surrounding whitespace,
+// which json.Unmarshal would otherwise reject
+func trimJSON(body []byte) []byte {
+	return bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(body), utf8BOM))
+}
+
+// readFileTarget reads a file:// target, transparently decompressing gzip
+// snapshots, which are recognised by their magic bytes
+func readFileTarget(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s - %v", path, err)
+	}
+	defer zr.Close()
+	data, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s - %v", path, err)
+	}
+	return data, nil
+}
+
+// fetchBody returns the response body for the insert's target. file://
+// targets are read from disk, which is handy for data written by another
+// process.
+func fetchBody(client *http.Client, config Config) ([]byte, error) {
+	target := config.GET_REQUEST_TARGET
+	if strings.HasPrefix(target, "file://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		return readFileTarget(u.Path)
+	}
+
+	req, err := http.NewRequest(config.METHOD, target, strings.NewReader(config.REQUEST_BODY))
+	if err != nil {
+		return nil, err
+	}
+	if config.CONTENT_TYPE != "" {
+		req.Header.Set("Content-Type", config.CONTENT_TYPE)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body - %v", err)
+	}
+	// Error responses fail the fetch, so maxRetries applies to them too
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, target)
+	}
+	return body, nil
+}
+
+// pointLines renders points as line protocol, adding the hostname and Influx
+// version tags and splitting any point with more than MAX_LINE_FIELDS fields
+// across several lines
+func pointLines(config Config, points []influx.Point) []string {
+	var lines []string
+	for _, point := range points {
+		if !replaceNonFinite(config, &point) {
+			continue
+		}
+		if config.MAX_NAME_LENGTH > 0 {
+			truncateNames(config, &point)
+		}
+		if config.HOSTNAME_TAG_KEY != "" {
+			point.AddTag(config.HOSTNAME_TAG_KEY, config.HOSTNAME)
+		}
+		for key, val := range config.NAME_TAGS {
+			point.AddTag(key, val)
+		}
+		if config.INFLUX_VERSION_TAG_KEY != "" {
+			point.AddTag(config.INFLUX_VERSION_TAG_KEY, influxVersion(config.DATABASE_URL))
+		}
+		for _, part := range point.Split(config.MAX_LINE_FIELDS) {
+			line := part.Line(config.PRECISION)
+			if config.VALIDATE_LINES {
+				if err := influx.ValidateLine(line); err != nil {
+					log.Printf("[%s] Dropping malformed line, %v : %s", config.DB_ATTRIBUTE_NAME, err, line)
+					continue
+				}
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
 }
 
 func sanitize(s string) string {
 	return strings.ReplaceAll(s, "-", "_")
 }
 
+// sourceHost returns the host portion of a scrape target. Only the host is
+// used so query strings don't blow up tag cardinality.
+func sourceHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// writeData sends the payload to the configured database, choosing the
+// transport from the URL scheme.
+func writeData(config Config, payload string) error {
+	if strings.HasPrefix(config.DATABASE_URL, "udp://") {
+		return sendDataToUDP(config.DATABASE_URL, payload, config.UDP_MAX_DATAGRAM)
+	}
+	writeURL := withPrecision(config.DATABASE_URL, config.PRECISION)
+	err := postWithRetries(config.DB_ATTRIBUTE_NAME, func() error {
+		return postDataToInfluxDB(writeURL, payload)
+	})
+	if err != nil {
+		bufferWrite(config, writeURL, payload)
+	}
+	return err
+}
+
+// writeLines is writeData for a batch of lines. Large HTTP batches are
+// streamed rather than joined into one string.
+func writeLines(config Config, lines []string) error {
+	size := 0
+	for _, line := range lines {
+		size += len(line) + 1
+	}
+	// Routed writes are split by measurement, so they can't be streamed as one
+	if size < streamThreshold || strings.HasPrefix(config.DATABASE_URL, "udp://") || len(writeRoutes) > 0 {
+		return writeData(config, strings.Join(lines, "\n"))
+	}
+	writeURL := withPrecision(config.DATABASE_URL, config.PRECISION)
+	err := postWithRetries(config.DB_ATTRIBUTE_NAME, func() error {
+		return streamLinesToInfluxDB(writeURL, lines)
+	})
+	if err != nil {
+		bufferWrite(config, writeURL, strings.Join(lines, "\n"))
+	}
+	return err
+}
+
+// bufferWrite keeps a failed write on disk when global.bufferDir is set
+func bufferWrite(config Config, writeURL, payload string) {
+	if writeBuffer == nil {
+		return
+	}
+	if err := writeBuffer.store(writeURL, payload); err != nil {
+		log.Printf("[%s] Failed to buffer write: %v", config.DB_ATTRIBUTE_NAME, err)
+	} else {
+		log.Printf("[%s] Buffered write to disk for retry", config.DB_ATTRIBUTE_NAME)
+	}
+}
+
+// withPrecision sets the precision query parameter to match our timestamps,
+// replacing any precision already in the URL since the timestamps are always
+// written in global.precision. InfluxDB v1 spells microseconds "u".
+func withPrecision(rawURL, precision string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	if precision == "us" && !strings.Contains(u.Path, "/api/v2/") {
+		precision = "u"
+	}
+	q.Set("precision", precision)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// defaultWriteTimeout bounds a write to InfluxDB unless overridden by
+// global.writeTimeout
+const defaultWriteTimeout = 10
+
+// writeClient sends writes to InfluxDB
+var writeClient = &http.Client{Timeout: defaultWriteTimeout * time.Second}
+
+// writeContentType and writeAccept are the headers sent with writes, set
+// from global.writeContentType and global.writeAccept for gateways in front
+// of InfluxDB that insist on particular values. No Accept header is sent
+// when writeAccept is empty.
+var (
+	writeContentType = "application/x-www-form-urlencoded"
+	writeAccept      = ""
+)
+
+// postDataToInfluxDB writes payload to url, or with global.routing set, sends
+// each line to the bucket its measurement routes to
 func postDataToInfluxDB(url, payload string) error {
-	resp, err := http.Post(url, "application/x-www-form-urlencoded", bytes.NewBufferString(payload))
+	if len(writeRoutes) == 0 {
+		return postBodyToInfluxDB(url, bytes.NewBufferString(payload))
+	}
+	for _, write := range writeRoutes.split(url, payload) {
+		if err := postBodyToInfluxDB(write.url, strings.NewReader(strings.Join(write.lines, "\n"))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamThreshold is the size above which batched lines are streamed to
+// InfluxDB instead of being joined into one string first
+const streamThreshold = 1 << 20
+
+// streamLinesToInfluxDB writes lines through a pipe, so a large batch is never
+// held in memory as a single body
+func streamLinesToInfluxDB(url string, lines []string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		for i, line := range lines {
+			if i > 0 {
+				if _, err := io.WriteString(pw, "\n"); err != nil {
+					return
+				}
+			}
+			if _, err := io.WriteString(pw, line); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	err := postBodyToInfluxDB(url, pr)
+	// Unblock the writer if the request ended before reading everything
+	pr.Close()
+	return err
+}
+
+func postBodyToInfluxDB(url string, body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return fmt.Errorf("post error: %v", err)
+	}
+	req.Header.Set("Content-Type", writeContentType)
+	if writeAccept != "" {
+		req.Header.Set("Accept", writeAccept)
+	}
+	if token := influxToken.get(); token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	resp, err := writeClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("post error: %v", err)
 	}
@@ -247,13 +1286,24 @@ func postDataToInfluxDB(url, payload string) error {
 	if resp.StatusCode != 204 {
 		return fmt.Errorf("non-204 response: %d", resp.StatusCode)
 	}
+	// A 204 can still carry a warning about points that were dropped, which
+	// would otherwise go unnoticed
+	for _, header := range []string{"X-Influxdb-Error", "Warning"} {
+		if warning := resp.Header.Get(header); warning != "" {
+			health.recordWriteWarning()
+			log.Printf("InfluxDB accepted a write with a warning (%s): %s", header, warning)
+		}
+	}
 	return nil
 }
 
 func (c *Config) printValues() {
 	if c.IS_DOCKER_STATS {
 		log.Printf("DOCKER_STATS              : [%s] %t", c.DB_ATTRIBUTE_NAME, c.IS_DOCKER_STATS)
-		log.Printf("DOCKER_ENDPOINT           : [%s] %s", c.DB_ATTRIBUTE_NAME, c.DOCKER_ENDPOINT)
+		log.Printf("DOCKER_ENDPOINTS          : [%s] %s", c.DB_ATTRIBUTE_NAME, strings.Join(c.DOCKER_ENDPOINTS, ", "))
+		if c.DOCKER_META_MEASUREMENT != "" {
+			log.Printf("DOCKER_META_MEASUREMENT   : [%s] %s", c.DB_ATTRIBUTE_NAME, c.DOCKER_META_MEASUREMENT)
+		}
 		log.Printf("SLEEP_TIME                : [%s] %d", c.DB_ATTRIBUTE_NAME, c.SLEEP_TIME)
 		log.Printf("RECORD_EMPTY_OR_ZERO      : [%s] %t", c.DB_ATTRIBUTE_NAME, c.RECORD_EMPTY_OR_ZERO)
 	} else {
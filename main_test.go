@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestWithPrecision(t *testing.T) {
+	tests := []struct {
+		url, precision, want string
+	}{
+		{"http://influx:8086/write?db=x", "ns", "http://influx:8086/write?db=x&precision=ns"},
+		// InfluxDB v1 spells microseconds u, v2 accepts us
+		{"http://influx:8086/write?db=x", "us", "http://influx:8086/write?db=x&precision=u"},
+		{"http://influx:8086/api/v2/write?bucket=b&org=o", "us", "http://influx:8086/api/v2/write?bucket=b&org=o&precision=us"},
+		// The configured precision wins over one already in the URL
+		{"http://influx:8086/write?db=x&precision=s", "ns", "http://influx:8086/write?db=x&precision=ns"},
+		{"http://influx:8086/api/v2/write?bucket=b&org=o&precision=ns", "s", "http://influx:8086/api/v2/write?bucket=b&org=o&precision=s"},
+	}
+	for _, tt := range tests {
+		if got := withPrecision(tt.url, tt.precision); got != tt.want {
+			t.Errorf("withPrecision(%s, %s) = %s, want %s", tt.url, tt.precision, got, tt.want)
+		}
+	}
+}
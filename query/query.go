@@ -1,12 +1,45 @@
 package query
 
 import (
+	"math"
 	"strconv"
 
 	"github.com/PaesslerAG/jsonpath"
 )
 
-func ExtractValueUsingJSONQuery(data interface{}, query string) string {
+// Resolve evaluates query against data and returns the raw match
+func Resolve(data interface{}, query string) (interface{}, error) {
+	return jsonpath.Get(query, data)
+}
+
+// Validate reports whether query is a syntactically valid JSONPath, so typos
+// are caught when the config is loaded instead of yielding empty fields
+func Validate(query string) error {
+	_, err := jsonpath.New(query)
+	return err
+}
+
+// ExtractValuesUsingJSONQuery returns every value matched by query, one per
+// array element, so that wildcard queries like $[*].value can be fanned out
+// instead of collapsing to the first match.
+func ExtractValuesUsingJSONQuery(data interface{}, query, numberFormat string) []string {
+	value, err := jsonpath.Get(query, data)
+	if err != nil {
+		return nil
+	}
+	if arr, ok := value.([]interface{}); ok {
+		values := make([]string, 0, len(arr))
+		for _, v := range arr {
+			values = append(values, ExtractValueUsingJSONQuery(v, "$", numberFormat))
+		}
+		return values
+	}
+	return []string{ExtractValueUsingJSONQuery(value, "$", numberFormat)}
+}
+
+// ExtractValueUsingJSONQuery returns the value matched by query as a string,
+// rendering numbers with numberFormat (see FormatNumber)
+func ExtractValueUsingJSONQuery(data interface{}, query, numberFormat string) string {
 	value, err := jsonpath.Get(query, data)
 	if err != nil {
 		return ""
@@ -17,13 +50,41 @@ func ExtractValueUsingJSONQuery(data interface{}, query string) string {
 	case int:
 		return strconv.Itoa(v)
 	case float64:
-		return strconv.FormatFloat(v, 'f', -1, 64)
+		return FormatNumber(v, numberFormat)
 	case []interface{}:
 		if len(v) > 0 {
-			return ExtractValueUsingJSONQuery(v[0], "$")
+			return ExtractValueUsingJSONQuery(v[0], "$", numberFormat)
 		}
 		return ""
 	default:
 		return ""
 	}
 }
+
+// ValidNumberFormat reports whether format is a supported number format
+func ValidNumberFormat(format string) bool {
+	switch format {
+	case "fixed", "auto", "scientific":
+		return true
+	}
+	return false
+}
+
+// FormatNumber renders a JSON number. fixed (the default) never uses an
+// exponent, so 1.23e9 becomes 1230000000; scientific always does; auto uses
+// an exponent only for very large or small magnitudes, which keeps huge
+// values from turning into long strings of digits.
+func FormatNumber(v float64, format string) string {
+	switch format {
+	case "scientific":
+		return strconv.FormatFloat(v, 'e', -1, 64)
+	case "auto":
+		// Same cut-off as fmt's %v
+		if abs := math.Abs(v); abs != 0 && (abs < 1e-4 || abs >= 1e21) {
+			return strconv.FormatFloat(v, 'e', -1, 64)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+}
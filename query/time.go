@@ -0,0 +1,122 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidTimeOutput reports whether output is a supported parsed-time output
+func ValidTimeOutput(output string) bool {
+	switch output {
+	case "unix_s", "unix_ms", "age_s":
+		return true
+	}
+	return false
+}
+
+// ParseTime reads val as a timestamp in format (rfc3339, unix, or a Go time
+// layout) and converts it to output: unix_s, unix_ms, or age_s (seconds
+// elapsed before now).
+func ParseTime(val, format, output string, now time.Time) (string, error) {
+	var t time.Time
+	switch strings.ToLower(format) {
+	case "rfc3339", "":
+		parsed, err := time.Parse(time.RFC3339Nano, val)
+		if err != nil {
+			return "", err
+		}
+		t = parsed
+	case "unix":
+		seconds, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return "", fmt.Errorf("value %q is not a unix timestamp", val)
+		}
+		t = time.Unix(0, int64(seconds*float64(time.Second)))
+	default:
+		parsed, err := time.Parse(format, val)
+		if err != nil {
+			return "", err
+		}
+		t = parsed
+	}
+
+	switch output {
+	case "unix_ms":
+		return strconv.FormatInt(t.UnixMilli(), 10), nil
+	case "age_s":
+		return strconv.FormatFloat(now.Sub(t).Seconds(), 'f', -1, 64), nil
+	default:
+		return strconv.FormatInt(t.Unix(), 10), nil
+	}
+}
+
+// durationUnit returns the length of a unit accepted by ParseDuration
+func durationUnit(unit string) (time.Duration, bool) {
+	switch unit {
+	case "ns":
+		return time.Nanosecond, true
+	case "us", "µs":
+		return time.Microsecond, true
+	case "ms":
+		return time.Millisecond, true
+	case "s", "sec", "secs", "second", "seconds":
+		return time.Second, true
+	case "m", "min", "mins", "minute", "minutes":
+		return time.Minute, true
+	case "h", "hr", "hrs", "hour", "hours":
+		return time.Hour, true
+	case "d", "day", "days":
+		return 24 * time.Hour, true
+	case "w", "week", "weeks":
+		return 7 * 24 * time.Hour, true
+	}
+	return 0, false
+}
+
+// ParseDuration reads val as a Go-style (72h, 1h30m) or compound (3d4h15m,
+// 2 days 3 hours) duration and returns the total seconds. A bare number is
+// taken as seconds.
+func ParseDuration(val string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(val))
+	if s == "" {
+		return "", fmt.Errorf("empty duration")
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.FormatFloat(seconds, 'f', -1, 64), nil
+	}
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	}
+
+	var total float64
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			break
+		}
+		numEnd := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if numEnd <= 0 {
+			return "", fmt.Errorf("invalid duration %q", val)
+		}
+		n, err := strconv.ParseFloat(s[:numEnd], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid duration %q", val)
+		}
+		s = strings.TrimLeft(s[numEnd:], " ")
+		unitEnd := strings.IndexFunc(s, func(r rune) bool { return (r >= '0' && r <= '9') || r == '.' || r == ' ' || r == ',' })
+		if unitEnd < 0 {
+			unitEnd = len(s)
+		}
+		unit, ok := durationUnit(s[:unitEnd])
+		if !ok {
+			return "", fmt.Errorf("invalid duration %q, unknown unit %q", val, s[:unitEnd])
+		}
+		total += n * unit.Seconds()
+		s = s[unitEnd:]
+	}
+	return strconv.FormatFloat(sign*total, 'f', -1, 64), nil
+}
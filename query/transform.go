@@ -0,0 +1,117 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Transform modifies an extracted value before it is written
+type Transform func(string) (string, error)
+
+// transformBuilders holds the built-in transforms. Each builder receives the
+// text after the ':' in a spec such as "scale:0.001" (empty when absent).
+var transformBuilders = map[string]func(arg string) (Transform, error){
+	"scale": func(arg string) (Transform, error) {
+		factor, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("scale requires a number, got %q", arg)
+		}
+		return numericTransform(func(v float64) float64 { return v * factor }), nil
+	},
+	"offset": func(arg string) (Transform, error) {
+		offset, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("offset requires a number, got %q", arg)
+		}
+		return numericTransform(func(v float64) float64 { return v + offset }), nil
+	},
+	"round": func(arg string) (Transform, error) {
+		places := 0
+		if arg != "" {
+			var err error
+			if places, err = strconv.Atoi(arg); err != nil || places < 0 {
+				return nil, fmt.Errorf("round requires a non-negative integer, got %q", arg)
+			}
+		}
+		pow := math.Pow(10, float64(places))
+		return numericTransform(func(v float64) float64 { return math.Round(v*pow) / pow }), nil
+	},
+	"abs": func(arg string) (Transform, error) {
+		return numericTransform(math.Abs), nil
+	},
+	"strip_unit": func(arg string) (Transform, error) {
+		return func(val string) (string, error) {
+			number := leadingNumber.FindString(strings.TrimSpace(val))
+			if number == "" {
+				return "", fmt.Errorf("no number found in %q", val)
+			}
+			return number, nil
+		}, nil
+	},
+	"map": func(arg string) (Transform, error) {
+		mapping := make(map[string]string)
+		for _, pair := range strings.Split(arg, ",") {
+			from, to, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("map entries must be from=to, got %q", pair)
+			}
+			mapping[strings.TrimSpace(from)] = strings.TrimSpace(to)
+		}
+		return func(val string) (string, error) {
+			if mapped, ok := mapping[val]; ok {
+				return mapped, nil
+			}
+			return val, nil
+		}, nil
+	},
+	"default": func(arg string) (Transform, error) {
+		return func(val string) (string, error) {
+			if val == "" {
+				return arg, nil
+			}
+			return val, nil
+		}, nil
+	},
+}
+
+var leadingNumber = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?`)
+
+// numericTransform wraps a float operation. Empty values pass through so a
+// missing field stays missing instead of becoming an error.
+func numericTransform(op func(float64) float64) Transform {
+	return func(val string) (string, error) {
+		if val == "" {
+			return val, nil
+		}
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return "", fmt.Errorf("value %q is not numeric", val)
+		}
+		return strconv.FormatFloat(op(v), 'f', -1, 64), nil
+	}
+}
+
+// ParseTransform builds a transform from a spec like "round:2"
+func ParseTransform(spec string) (Transform, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	builder, ok := transformBuilders[strings.TrimSpace(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %q", name)
+	}
+	return builder(arg)
+}
+
+// ApplyTransforms runs the transforms over val in order, stopping at the
+// first error.
+func ApplyTransforms(val string, transforms []Transform) (string, error) {
+	for _, transform := range transforms {
+		var err error
+		if val, err = transform(val); err != nil {
+			return "", err
+		}
+	}
+	return val, nil
+}
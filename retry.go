@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRetryBudget is the number of write retries allowed per minute across
+// all inserts unless overridden by global.retryBudget
+const defaultRetryBudget = 30
+
+// defaultInitialBackoff is the first delay before re-fetching a failed scrape
+// unless overridden by initialBackoff
+const defaultInitialBackoff = 500
+
+// writeRetries bounds HTTP write retries. nil when global.writeRetries isn't
+// set, in which case a failed write isn't retried.
+var writeRetries *retryBudget
+
+// retryBudget is a token bucket shared by every write, so a broad outage
+// can't turn into a storm of N writes times M retries once InfluxDB starts
+// to recover. Writes that find it empty fail straight away.
+type retryBudget struct {
+	mu         sync.Mutex
+	maxRetries int
+	capacity   float64
+	tokens     float64
+	perSecond  float64
+	refilledAt time.Time
+}
+
+func newRetryBudget(maxRetries, perMinute int) *retryBudget {
+	if perMinute <= 0 {
+		perMinute = defaultRetryBudget
+	}
+	return &retryBudget{
+		maxRetries: maxRetries,
+		capacity:   float64(perMinute),
+		tokens:     float64(perMinute),
+		perSecond:  float64(perMinute) / 60,
+		refilledAt: time.Now(),
+	}
+}
+
+// take spends one retry, reporting false if the budget is exhausted
+func (r *retryBudget) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.tokens = min(r.capacity, r.tokens+now.Sub(r.refilledAt).Seconds()*r.perSecond)
+	r.refilledAt = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// postWithRetries calls post, retrying failures with a growing delay while
+// the shared budget allows
+func postWithRetries(name string, post func() error) error {
+	err := post()
+	if writeRetries == nil {
+		return err
+	}
+	for attempt := 1; err != nil && attempt <= writeRetries.maxRetries; attempt++ {
+		if !writeRetries.take() {
+			log.Printf("[%s] Retry budget exhausted, not retrying write", name)
+			return err
+		}
+		log.Printf("[%s] Write failed, retry %d of %d : %v", name, attempt, writeRetries.maxRetries, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+		err = post()
+	}
+	return err
+}
+
+// fetchWithRetries calls fetchBody, retrying a failed request up to
+// MAX_RETRIES times. The delay doubles after each attempt, with jitter so
+// inserts that failed together don't retry in lockstep. Retrying stops early
+// once the next attempt would start more than SLEEP_TIME after the first, so
+// a flapping endpoint can't hold up the insert's next cycle.
+func fetchWithRetries(client *http.Client, config Config) ([]byte, error) {
+	deadline := time.Now().Add(time.Duration(config.SLEEP_TIME) * time.Second)
+	backoff := time.Duration(config.INITIAL_BACKOFF) * time.Millisecond
+	body, err := fetchBody(client, config)
+	for attempt := 1; err != nil && attempt <= config.MAX_RETRIES; attempt++ {
+		// Wait between half and all of the backoff
+		delay := backoff/2 + rand.N(backoff/2+1)
+		if time.Now().Add(delay).After(deadline) {
+			log.Printf("[%s] Not retrying scrape, retry %d would pass the %ds deadline", config.DB_ATTRIBUTE_NAME, attempt, config.SLEEP_TIME)
+			break
+		}
+		log.Printf("[%s] Scrape failed, retry %d of %d in %v : %v", config.DB_ATTRIBUTE_NAME, attempt, config.MAX_RETRIES, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+		body, err = fetchBody(client, config)
+		backoff *= 2
+	}
+	return body, err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// route sends lines whose measurement matches the Match glob to another
+// bucket, or database for v1 write URLs. Bucket and DB stand in for each
+// other when only one is set.
+type route struct {
+	Match  string `yaml:"match"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	DB     string `yaml:"db"`
+}
+
+// routes is global.routing. Routes are checked in order and the first match
+// wins; lines matching none go to the insert's own write URL.
+type routes []route
+
+// writeRoutes is set from global.routing. Empty when every line goes to the
+// insert's write URL.
+var writeRoutes routes
+
+func (r routes) validate() error {
+	for i, rt := range r {
+		if rt.Match == "" {
+			return fmt.Errorf("global.routing[%d] must have a match pattern", i)
+		}
+		if _, err := path.Match(rt.Match, ""); err != nil {
+			return fmt.Errorf("global.routing[%d] match %q is not a valid pattern", i, rt.Match)
+		}
+		if rt.Bucket == "" && rt.DB == "" {
+			return fmt.Errorf("global.routing[%d] must have a bucket or db", i)
+		}
+	}
+	return nil
+}
+
+// target returns the write URL for lines of measurement, which is writeURL
+// pointed at the first matching route's bucket, or writeURL itself when no
+// route matches
+func (r routes) target(writeURL, measurement string) string {
+	for _, rt := range r {
+		if ok, _ := path.Match(rt.Match, measurement); !ok {
+			continue
+		}
+		u, err := url.Parse(writeURL)
+		if err != nil {
+			return writeURL
+		}
+		q := u.Query()
+		if strings.Contains(u.Path, "/api/v2/") {
+			bucket := rt.Bucket
+			if bucket == "" {
+				bucket = rt.DB
+			}
+			q.Set("bucket", bucket)
+			if rt.Org != "" {
+				q.Del("orgID")
+				q.Set("org", rt.Org)
+			}
+		} else {
+			db := rt.DB
+			if db == "" {
+				db = rt.Bucket
+			}
+			q.Set("db", db)
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return writeURL
+}
+
+// routedWrite is the part of a payload bound for one write URL
+type routedWrite struct {
+	url   string
+	lines []string
+}
+
+// split groups the lines of payload by their routed write URL. Groups are in
+// order of first appearance and lines keep their order within a group.
+func (r routes) split(writeURL, payload string) []routedWrite {
+	var writes []routedWrite
+	index := make(map[string]int)
+	for _, line := range strings.Split(payload, "\n") {
+		if line == "" {
+			continue
+		}
+		target := r.target(writeURL, lineMeasurement(line))
+		i, ok := index[target]
+		if !ok {
+			i = len(writes)
+			index[target] = i
+			writes = append(writes, routedWrite{url: target})
+		}
+		writes[i].lines = append(writes[i].lines, line)
+	}
+	return writes
+}
+
+// lineMeasurement returns the unescaped measurement name of a line protocol
+// line, which ends at the first unescaped comma or space
+func lineMeasurement(line string) string {
+	var name strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				name.WriteByte(line[i])
+			}
+		case ',', ' ':
+			return name.String()
+		default:
+			name.WriteByte(c)
+		}
+	}
+	return name.String()
+}
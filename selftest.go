@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"scrape/influx"
+)
+
+const (
+	// selfTestMeasurement receives the --selftest points
+	selfTestMeasurement = "scrape_selftest"
+	// selfTestTimeout is how long a written test point has to show up in
+	// query results
+	selfTestTimeout = 10 * time.Second
+)
+
+// selfTest writes a uniquely tagged point to every database the inserts use
+// and reads it back, checking the write path, credentials and bucket
+// permissions end to end. It returns false if any check failed.
+func selfTest(configs []Config) bool {
+	d := &diagnosis{}
+	tested := make(map[string]bool)
+	for _, config := range configs {
+		if tested[config.DATABASE_URL] {
+			continue
+		}
+		tested[config.DATABASE_URL] = true
+		selfTestDatabase(d, config)
+	}
+	if d.failed {
+		fmt.Println("Self-test failed")
+		return false
+	}
+	fmt.Println("Self-test passed")
+	return true
+}
+
+func selfTestDatabase(d *diagnosis, config Config) {
+	if strings.HasPrefix(config.DATABASE_URL, "udp://") {
+		d.skip("selftest", "%s is UDP, which can't be read back", config.DATABASE_URL)
+		return
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+	point := influx.Point{
+		Measurement: selfTestMeasurement,
+		Tags:        map[string]string{"selftest_id": id},
+		Fields:      map[string]interface{}{"ok": 1},
+		Time:        time.Now(),
+	}
+	writeURL := withPrecision(config.DATABASE_URL, config.PRECISION)
+	if err := postDataToInfluxDB(writeURL, point.Line(config.PRECISION)); err != nil {
+		d.fail("write", "%s : %v", config.DATABASE_URL, err)
+		return
+	}
+	d.pass("write", "%s accepted %s,selftest_id=%s", config.DATABASE_URL, selfTestMeasurement, id)
+
+	// Read back from wherever global.routing sent the point
+	req, err := selfTestQuery(writeRoutes.target(writeURL, selfTestMeasurement), id)
+	if err != nil {
+		d.fail("query", "%v", err)
+		return
+	}
+	// Only the endpoint is reported, the query string carries the query and
+	// any v1 credentials
+	endpoint := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	deadline := time.Now().Add(selfTestTimeout)
+	for {
+		found, err := selfTestFound(req, id)
+		switch {
+		case err != nil:
+			d.fail("query", "%s : %v", endpoint, err)
+			return
+		case found:
+			d.pass("query", "read the test point back from %s", endpoint)
+			return
+		case time.Now().After(deadline):
+			d.fail("query", "test point not found within %v at %s", selfTestTimeout, endpoint)
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// selfTestQuery builds the request that looks the test point up: a Flux
+// query against /api/v2/query for v2 write URLs, or InfluxQL against the
+// v1 /query endpoint
+func selfTestQuery(writeURL, id string) (*http.Request, error) {
+	u, err := url.Parse(writeURL)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	params.Del("precision")
+
+	if base, ok := strings.CutSuffix(u.Path, "/api/v2/write"); ok {
+		bucket := params.Get("bucket")
+		if bucket == "" {
+			return nil, fmt.Errorf("no bucket in write URL %s", u.Redacted())
+		}
+		params.Del("bucket")
+		u.Path = base + "/api/v2/query"
+		u.RawQuery = params.Encode()
+		flux := fmt.Sprintf(`from(bucket: %q) |> range(start: -1h) |> filter(fn: (r) => r._measurement == %q and r.selftest_id == %q)`, bucket, selfTestMeasurement, id)
+		req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(flux))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/vnd.flux")
+		req.Header.Set("Accept", "application/csv")
+		return req, nil
+	}
+
+	base, ok := strings.CutSuffix(u.Path, "/write")
+	if !ok {
+		return nil, fmt.Errorf("can't derive a query URL from write path %s", u.Path)
+	}
+	u.Path = base + "/query"
+	params.Set("q", fmt.Sprintf(`SELECT "ok" FROM %q WHERE "selftest_id" = '%s'`, selfTestMeasurement, id))
+	u.RawQuery = params.Encode()
+	return http.NewRequest(http.MethodGet, u.String(), nil)
+}
+
+// selfTestFound runs the lookup and reports whether the result mentions id
+func selfTestFound(req *http.Request, id string) (bool, error) {
+	// Each poll needs a fresh copy of the query body
+	attempt := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return false, err
+		}
+		attempt.Body = body
+	}
+	if token := influxToken.get(); token != "" {
+		attempt.Header.Set("Authorization", "Token "+token)
+	}
+	resp, err := writeClient.Do(attempt)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(result)))
+	}
+	return strings.Contains(string(result), id), nil
+}
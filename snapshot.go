@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"scrape/influx"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// snapshot keeps the last point of every series written by each insert, for
+// the /snapshot endpoint
+var snapshot = newSnapshotStore()
+
+// snapshotPoint is the JSON form of a recorded point
+type snapshotPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+type snapshotStore struct {
+	mu sync.Mutex
+	// last point per insert name, then per series (measurement and tags)
+	last map[string]map[string]snapshotPoint
+}
+
+func newSnapshotStore() *snapshotStore {
+	return &snapshotStore{last: make(map[string]map[string]snapshotPoint)}
+}
+
+// record stores points as the latest values for the insert name
+func (s *snapshotStore) record(name string, points []influx.Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series, ok := s.last[name]
+	if !ok {
+		series = make(map[string]snapshotPoint)
+		s.last[name] = series
+	}
+	for _, point := range points {
+		key := point.Measurement
+		for _, tag := range sortedKeys(point.Tags) {
+			key += "," + tag + "=" + point.Tags[tag]
+		}
+		// Copied, since the point's maps are still modified before writing
+		tags := make(map[string]string, len(point.Tags))
+		for tag, val := range point.Tags {
+			tags[tag] = val
+		}
+		fields := make(map[string]interface{}, len(point.Fields))
+		for field, val := range point.Fields {
+			fields[field] = snapshotValue(val)
+		}
+		series[key] = snapshotPoint{Measurement: point.Measurement, Tags: tags, Fields: fields, Time: point.Time}
+	}
+}
+
+// snapshotValue shows numeric strings as JSON numbers, as they are written
+func snapshotValue(val interface{}) interface{} {
+	s, ok := val.(string)
+	if !ok {
+		return val
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f
+	}
+	return s
+}
+
+func (s *snapshotStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	resp := make(map[string][]snapshotPoint, len(s.last))
+	for name, series := range s.last {
+		for _, key := range sortedKeys(series) {
+			resp[name] = append(resp[name], series[key])
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
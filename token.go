@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTokenCacheTTL bounds how long a token read from tokenFile is reused
+const defaultTokenCacheTTL = 30
+
+// influxToken supplies the API token sent with HTTP writes
+var influxToken = &tokenProvider{}
+
+// tokenProvider returns a static token, or re-reads a token file once the
+// cached copy is older than ttl so rotated tokens are picked up without a
+// restart.
+type tokenProvider struct {
+	mu     sync.Mutex
+	static string
+	file   string
+	ttl    time.Duration
+	cached string
+	readAt time.Time
+}
+
+func newTokenProvider(static, file string, ttl int) *tokenProvider {
+	if ttl <= 0 {
+		ttl = defaultTokenCacheTTL
+	}
+	return &tokenProvider{static: static, file: file, ttl: time.Duration(ttl) * time.Second}
+}
+
+func (t *tokenProvider) get() string {
+	if t.file == "" {
+		return t.static
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cached != "" && time.Since(t.readAt) < t.ttl {
+		return t.cached
+	}
+	data, err := os.ReadFile(t.file)
+	if err != nil {
+		// Keep using the last good token rather than failing every write
+		log.Printf("Failed to read token file %s: %v", t.file, err)
+		return t.cached
+	}
+	t.cached = strings.TrimSpace(string(data))
+	t.readAt = time.Now()
+	return t.cached
+}
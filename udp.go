@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultUDPMaxDatagram keeps datagrams below a typical ethernet MTU
+const defaultUDPMaxDatagram = 1400
+
+// outputPrecision is the precision timestamps are written in for database
+// URL db. UDP has no way to pass a precision, and Telegraf and InfluxDB UDP
+// listeners read timestamps as nanoseconds, so UDP outputs always use ns.
+func outputPrecision(db, precision string) string {
+	if strings.HasPrefix(db, "udp://") {
+		return "ns"
+	}
+	return precision
+}
+
+// sendDataToUDP writes line protocol to a udp://host:port listener such as
+// Telegraf's socket_listener. Payloads larger than maxDatagram are split on
+// line boundaries so no point is cut in half.
+func sendDataToUDP(url, payload string, maxDatagram int) error {
+	addr := strings.TrimPrefix(url, "udp://")
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("udp dial error: %v", err)
+	}
+	defer conn.Close()
+
+	for _, datagram := range splitDatagrams(payload, maxDatagram) {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			return fmt.Errorf("udp write error: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitDatagrams groups lines into chunks no larger than max bytes. A single
+// line longer than max is sent on its own rather than being truncated.
+func splitDatagrams(payload string, max int) []string {
+	var datagrams []string
+	current := ""
+	for _, line := range strings.Split(payload, "\n") {
+		if line == "" {
+			continue
+		}
+		if current != "" && len(current)+1+len(line) > max {
+			datagrams = append(datagrams, current)
+			current = ""
+		}
+		if current == "" {
+			current = line
+		} else {
+			current += "\n" + line
+		}
+	}
+	if current != "" {
+		datagrams = append(datagrams, current)
+	}
+	return datagrams
+}